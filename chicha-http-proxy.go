@@ -2,22 +2,75 @@ package main
 
 import (
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"container/list"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"flag"
 	"fmt"
 	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"hash/fnv"
+	"html/template"
 	"io"
 	"log"
+	mathrand "math/rand/v2"
+	"mime"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/http/pprof"
 	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 // Program version (will be printed if the --version flag is used)
 var version = "dev"
 
+// processStart anchors the uptime shown on the admin dashboard; unlike the stats window it survives counter resets.
+var processStart = time.Now()
+
+// dashboardFS carries the admin dashboard template inside the binary so the page needs no files or external assets at runtime.
+//
+//go:embed templates/dashboard.html
+var dashboardFS embed.FS
+
+var dashboardTemplate = template.Must(template.ParseFS(dashboardFS, "templates/dashboard.html"))
+
+// Color palette keeps help output and startup failures readable on both dark and light backgrounds.
+const (
+	colorReset       = "\033[0m"
+	colorTitle       = "\033[38;5;39m"
+	colorSection     = "\033[38;5;69m"
+	colorHighlight   = "\033[38;5;208m"
+	colorDescription = "\033[38;5;244m"
+	colorError       = "\033[38;5;196m"
+)
+
 // hostSelectionMode enumerates how we pick the upstream Host header so callers can switch strategies explicitly.
 type hostSelectionMode int
 
@@ -34,299 +87,5819 @@ type proxyConfig struct {
 	forwardedHost string
 	upstreamHost  string
 	hostMode      hostSelectionMode
-	transport     *http.Transport
+	// client is shared by every request so redirect hops reuse pooled upstream connections; it never follows redirects itself.
+	client *http.Client
+	// upstreamUser carries credentials from --target-url userinfo, sent as Basic auth instead of in the dialed URL.
+	upstreamUser *url.Userinfo
+	// addPathPrefix and stripPathPrefix mount the backend under (or lift it out of) a subpath without a routing table.
+	addPathPrefix    string
+	stripPathPrefix  string
+	rejectPrefixMiss bool
+	// defaultTargetURL receives paths outside stripPathPrefix unchanged; without it, rejected misses get noRouteStatus.
+	defaultTargetURL  string
+	defaultTargetHost string
+	defaultTargetUser *url.Userinfo
+	noRouteStatus     int
+	// errorPage replaces the bare 502/503 text with a branded page; retryAfter tells clients when to try again.
+	errorPage  *template.Template
+	retryAfter int
+	// upstreamTimeout bounds the whole upstream exchange; deadlineHeader/deadlineFormat tell the backend about that bound.
+	upstreamTimeout time.Duration
+	deadlineHeader  string
+	deadlineFormat  string
+	// viaName identifies this hop in the Via chain (empty hides the proxy); forwardedServer fills X-Forwarded-Server.
+	viaName         string
+	forwardedServer string
+	// canonicalHost is "apex" or "www" when one hostname form should 301 to the other.
+	canonicalHost string
+	// stats feeds the admin counters; it is shared by every listener.
+	stats *proxyStats
+	// bufferResponses reads whole upstream bodies before answering, trading memory for releasing backends early.
+	bufferResponses bool
+	// forwardHeadersOnly streams request and response bodies straight through, so memory stays flat whatever their size.
+	forwardHeadersOnly bool
+	// methodOverrideHeader lets POST requests ask for PUT, PATCH or DELETE via this header or a _method query parameter.
+	methodOverrideHeader string
+	// requestIDHeader carries the request ID to the backend and back to the client; the ID is logged either way.
+	requestIDHeader string
+	// logTLS logs the negotiated TLS version, cipher suite and SNI of every HTTPS request.
+	logTLS bool
+	// logLatency splits each request's time into upstream time-to-first-byte and total time including body streaming.
+	logLatency bool
+	// backendOverride honours X-Proxy-Backend from clients inside trustedProxies, for pinning a request to one instance.
+	backendOverride bool
+	trustedProxies  []*net.IPNet
+	// softTimeout ends streamed bodies of unknown length early, sending what arrived plus a truncation trailer instead of an error.
+	softTimeout time.Duration
+	// transforms rewrite upstream responses by media type, in order, after redirects are resolved and before buffering.
+	transforms []responseTransform
+	// trailingSlash is "add", "remove" or empty to preserve paths; trailingSlashRewrite fixes the path silently instead of redirecting.
+	trailingSlash        string
+	trailingSlashRewrite bool
+	// statusRemap translates upstream status codes; remapStatusBody replaces the body of remapped responses with the new status text.
+	statusRemap     map[int]int
+	remapStatusBody bool
+	// statusBodies replace the body of upstream responses with these statuses, keyed by the upstream status.
+	statusBodies map[int]statusBody
+	// logHeaders dumps forwarded request and upstream response headers; values of redactHeaders (canonical names) print as ***.
+	logHeaders    bool
+	redactHeaders map[string]bool
+	// canaryURL receives canaryPercent of clients, chosen by a hash of canaryCookie (or the client IP) so each client sticks to one variant.
+	canaryURL     string
+	canaryHost    string
+	canaryUser    *url.Userinfo
+	canaryPercent int
+	canaryCookie  string
+	// hashRing picks the backend for requests carrying hashHeader, so one key value always lands on the same backend.
+	hashHeader string
+	hashRing   *hashRing
+	// maxURILength rejects longer request targets with 414 before any work is done; 0 disables the check.
+	maxURILength int
+	// forwardClientCert passes the verified client certificate identity upstream; forwardClientCertPEM adds the whole certificate.
+	forwardClientCert    bool
+	forwardClientCertPEM bool
+	// accessLogFormat renders one nginx-style line per request on stdout; empty disables the access log.
+	accessLogFormat string
+	// accessLogJSON receives one JSON record per request for log shippers, independently of accessLogFormat.
+	accessLogJSON *log.Logger
+	// stripResponseHeaders never reach clients; a non-empty allowResponseHeaders passes only those (canonical names) plus body framing.
+	stripResponseHeaders map[string]bool
+	allowResponseHeaders map[string]bool
+	// window collects per-interval request counts and latencies for --stats-interval; nil when the summary is disabled.
+	window *windowStats
+	// maxRedirects bounds the upstream redirects the proxy follows itself; 0 passes every redirect to the client.
+	maxRedirects int
+	// redirectTimeout bounds a followed redirect chain, from the first request until the final hop's headers.
+	redirectTimeout time.Duration
+	// faultDelay/faultAbortStatus are chaos-testing faults applied to the given percentage of requests; zero percentages disable them.
+	faultDelay        time.Duration
+	faultDelayPercent int
+	faultAbortStatus  int
+	faultAbortPercent int
+	// serverTiming adds a Server-Timing header splitting latency into proxy, DNS, connect, TLS and upstream phases.
+	serverTiming bool
+	// jsonErrors renders proxy-generated errors as JSON objects for API clients instead of plain text.
+	jsonErrors bool
+	// allowedHosts lists the lower-cased hostnames (or *.suffix wildcards) clients may ask for; empty accepts any Host.
+	allowedHosts []string
+	// decompressRequest decodes gzip and deflate request bodies for backends that cannot, up to maxDecompressedBody bytes.
+	decompressRequest   bool
+	maxDecompressedBody int64
+	// retries re-sends requests that failed in transport; delays grow from retryBase to retryMax, randomised per retryJitter.
+	retries     int
+	retryBase   time.Duration
+	retryMax    time.Duration
+	retryJitter string
+	// auditLog receives the request bodies of auditPaths, capped at auditMaxBody bytes, with auditRedact JSON fields masked.
+	auditLog     *log.Logger
+	auditPaths   []string
+	auditMaxBody int
+	auditRedact  map[string]bool
+	// backendTimeouts replace upstreamTimeout for the backend hosts they name, so a slow backend can get longer than a fast one.
+	backendTimeouts map[string]time.Duration
+	// normalizePath resolves dot segments and duplicate slashes before routing; normalizeRouteOnly keeps the client's path for the backend.
+	normalizePath      bool
+	normalizeRouteOnly bool
+	// maxHeaderCount rejects requests carrying more header lines than this with 431; 0 disables the check.
+	maxHeaderCount int
+	// securityHeaders are added to every response: preset entries only where the backend sent none, overrides always.
+	securityHeaders []securityHeader
+	// optionsHeaders, when set, answer OPTIONS requests with 204 and these headers without contacting the backend.
+	optionsHeaders http.Header
+	// health turns consecutive transport failures into backend state change events.
+	health *backendHealth
+	// idempotency replays stored responses to POST and PATCH requests repeating an idempotencyHeader value; nil disables it.
+	idempotency       *idempotencyCache
+	idempotencyHeader string
 }
 
-// proxyHandler returns an HTTP handler function that forwards incoming requests to a specified target URL (reverse proxy functionality).
-func proxyHandler(cfg proxyConfig) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		// Attempt to read the request body (if present)
-		var body []byte
-		if r.Body != nil {
-			var err error
-			body, err = io.ReadAll(r.Body)
-			if err != nil {
-				http.Error(w, "Failed to read request body", http.StatusInternalServerError)
-				log.Printf("Error reading request body: %v", err)
-				return
-			}
-		}
+// framingHeaders describe how the body bytes are encoded, so an allowlist cannot drop them without corrupting responses.
+var framingHeaders = []string{"Content-Length", "Content-Encoding", "Content-Range", "Transfer-Encoding", "Trailer"}
 
-		// Construct the initial forwarding URL by combining the target URL with the requested path
-		originalURL := cfg.targetURL + r.URL.Path
-		currentURL := originalURL
+// clientCertHeaders carry the verified mTLS identity upstream; client-supplied copies are always removed first.
+var clientCertHeaders = []string{"X-Client-Cert", "X-Client-Cert-Subject", "X-Client-Cert-Issuer", "X-Client-Cert-Serial"}
 
-		// Create an HTTP client for making outgoing requests to the target server.
-		// We skip certificate verification because the proxy is meant to trust the upstream blindly.
-		client := &http.Client{Transport: cfg.transport}
+// defaultRedactedHeaders never reach the logs in cleartext; --redact-header extends the list.
+var defaultRedactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key"}
 
-		for {
-			// Create a new outgoing request using the incoming request's method, headers, and body.
-			req, err := http.NewRequest(r.Method, currentURL, bytes.NewReader(body))
-			if err != nil {
-				http.Error(w, "Failed to create request", http.StatusInternalServerError)
-				log.Printf("Error creating request: %v", err)
-				return
-			}
+// truncatedTrailer is announced on soft-deadline streams and set when the proxy stopped reading before the upstream finished.
+const truncatedTrailer = "X-Proxy-Truncated"
 
-			// Copy all headers from the incoming request to the outgoing request.
-			for header, values := range r.Header {
-				for _, value := range values {
-					req.Header.Add(header, value)
-				}
-			}
+// backendOverrideHeader names the debugging header that routes a single request to a specific backend.
+const backendOverrideHeader = "X-Proxy-Backend"
 
-			// Populate X-Forwarded-* headers so the upstream can recover client context.
-			// Using Set ensures we do not accumulate duplicates if the client already supplied values.
-			forwardedFor := r.RemoteAddr
-			if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
-				forwardedFor = host
-			}
-			req.Header.Set("X-Forwarded-For", forwardedFor)
-			req.Header.Set("X-Forwarded-Proto", "https")
+// proxyStats keeps runtime counters for /admin/stats without any external metrics stack.
+// Totals are atomics on the hot path; the per-status and per-backend maps share one mutex.
+type proxyStats struct {
+	requests atomic.Int64
+	errors   atomic.Int64
+	// bytesReceived and bytesSent total the request and response body bytes exchanged with clients.
+	bytesReceived atomic.Int64
+	bytesSent     atomic.Int64
 
-			// Determine which host should be visible to the upstream based on the configured strategy.
-			// Keeping this centralised avoids subtle header divergence across Host and X-Forwarded-Host.
-			backendHost := cfg.forwardedHost
-			if backendHost == "" || cfg.hostMode == hostFromTarget {
-				backendHost = cfg.upstreamHost
-			}
+	mu       sync.Mutex
+	since    time.Time
+	statuses map[int]int64
+	backends map[string]int64
+	lastSeen map[string]time.Time
+	tls      map[string]int64
+	recent   []errorEvent
+}
 
-			forwardedHost := cfg.forwardedHost
-			if forwardedHost == "" {
-				forwardedHost = backendHost
-			}
+// recentErrorsKept bounds the error history so a failing backend cannot grow it without limit.
+const recentErrorsKept = 20
 
-			// Enforce Host headers so origin servers and logs observe the configured host while X-Forwarded-Host keeps the public entry point when required.
-			req.Host = backendHost
-			req.Header.Set("Host", backendHost)
-			req.Header.Set("X-Forwarded-Host", forwardedHost)
+// errorEvent is one proxy-generated error response, kept for the admin dashboard.
+type errorEvent struct {
+	Time    time.Time `json:"time"`
+	Status  int       `json:"status"`
+	Message string    `json:"message"`
+}
 
-			// Preserve the query string parameters
-			req.URL.RawQuery = r.URL.RawQuery
+// newProxyStats returns zeroed counters.
+func newProxyStats() *proxyStats {
+	stats := &proxyStats{}
+	stats.reset()
+	return stats
+}
 
-			// Perform the HTTP request to the target server
-			resp, err := client.Do(req)
-			if err != nil {
-				http.Error(w, "Error forwarding request", http.StatusBadGateway)
-				log.Printf("Error forwarding request: %v", err)
-				return
-			}
-			defer resp.Body.Close()
+// reset zeroes every counter so operators can measure a specific test window.
+func (s *proxyStats) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests.Store(0)
+	s.errors.Store(0)
+	s.bytesReceived.Store(0)
+	s.bytesSent.Store(0)
+	s.since = time.Now()
+	s.statuses = make(map[int]int64)
+	s.backends = make(map[string]int64)
+	s.lastSeen = make(map[string]time.Time)
+	s.tls = make(map[string]int64)
+	s.recent = nil
+}
 
-			// If the response is a redirect (3xx), follow it
-			if resp.StatusCode >= 300 && resp.StatusCode < 400 {
-				location, err := resp.Location()
-				if err != nil {
-					http.Error(w, "Failed to handle redirect", http.StatusInternalServerError)
-					log.Printf("Error handling redirect: %v", err)
-					return
-				}
-				currentURL = location.String()
-				log.Printf("Redirecting to: %s", currentURL)
-				continue
-			}
+// recordStatus counts the status sent to the client; 0 means the client left before any response.
+func (s *proxyStats) recordStatus(status int) {
+	s.requests.Add(1)
+	if status == 0 {
+		return
+	}
+	s.mu.Lock()
+	s.statuses[status]++
+	s.mu.Unlock()
+}
 
-			// Copy the response headers from the target server to the client
-			for header, values := range resp.Header {
-				for _, value := range values {
-					w.Header().Add(header, value)
-				}
-			}
+// recordBytes adds one request's client-side body traffic to the bandwidth totals.
+func (s *proxyStats) recordBytes(received, sent int64) {
+	s.bytesReceived.Add(received)
+	s.bytesSent.Add(sent)
+}
 
-			// Set the status code in the client response
-			w.WriteHeader(resp.StatusCode)
+// recordBackend counts a response received from the given upstream host.
+func (s *proxyStats) recordBackend(host string) {
+	s.mu.Lock()
+	s.backends[host]++
+	s.lastSeen[host] = time.Now()
+	s.mu.Unlock()
+}
 
-			// Copy the response body
-			responseBody, err := io.ReadAll(resp.Body)
-			if err != nil {
-				log.Printf("Error reading response body: %v", err)
-				return
-			}
-			_, err = w.Write(responseBody)
-			if err != nil {
-				log.Printf("Error writing response body: %v", err)
-			}
-			return
-		}
+// recordError counts a proxy-generated error and remembers it, newest first, for the dashboard.
+func (s *proxyStats) recordError(status int, message string) {
+	s.errors.Add(1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recent = append([]errorEvent{{Time: time.Now(), Status: status, Message: message}}, s.recent...)
+	if len(s.recent) > recentErrorsKept {
+		s.recent = s.recent[:recentErrorsKept]
 	}
 }
 
-// reportFatal prints failures to both standard streams so systemd surfaces them no matter how the unit is configured.
-// We keep logging in place to preserve historical behaviour while still exiting immediately after an unrecoverable error.
-func reportFatal(message string) {
-	fmt.Fprintln(os.Stdout, message)
-	fmt.Fprintln(os.Stderr, message)
-	log.Println(message)
+// recordTLS counts HTTPS requests per negotiated version and cipher suite so weak clients show up before tightening TLS.
+func (s *proxyStats) recordTLS(state *tls.ConnectionState) {
+	key := tls.VersionName(state.Version) + " " + tls.CipherSuiteName(state.CipherSuite)
+	s.mu.Lock()
+	s.tls[key]++
+	s.mu.Unlock()
 }
 
-// exitWithError wraps contextual failures, reports them loudly, and terminates to avoid partial startup states.
-// Writing to STDOUT, STDERR, and the logger guarantees visibility across manual runs and systemd invocations.
-func exitWithError(context string, err error) {
-	message := fmt.Sprintf("%s: %v", context, err)
-	reportFatal(message)
-	os.Exit(1)
+// windowStats accumulates one --stats-interval window for the periodic console summary.
+// It is separate from proxyStats so resetting the admin counters does not disturb the rolling windows and vice versa.
+type windowStats struct {
+	mu        sync.Mutex
+	requests  int64
+	errors    int64
+	latencies []time.Duration
 }
 
-func main() {
-	// Color palette keeps help output readable on both dark and light backgrounds.
-	const (
-		colorReset       = "\033[0m"
-		colorTitle       = "\033[38;5;39m"
-		colorSection     = "\033[38;5;69m"
-		colorHighlight   = "\033[38;5;208m"
-		colorDescription = "\033[38;5;244m"
-	)
-
-	// Custom usage function keeps the CLI friendly and shows minimal and advanced recipes.
-	flag.Usage = func() {
-		fmt.Printf("%sChicha HTTP Proxy%s\n", colorTitle, colorReset)
-		fmt.Printf("%sMinimalist reverse proxy with optional automatic TLS.%s\n\n", colorDescription, colorReset)
+// windowSamplesKept bounds latency memory per window; beyond it reservoir sampling keeps the percentiles representative.
+const windowSamplesKept = 1 << 16
 
-		fmt.Printf("%sUsage%s\n", colorSection, colorReset)
-		fmt.Printf("  chicha-http-proxy [flags]\n\n")
+// observe records one finished request; 5xx and abandoned requests (status 0) count as errors.
+func (ws *windowStats) observe(status int, latency time.Duration) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.requests++
+	if status == 0 || status >= 500 {
+		ws.errors++
+	}
+	if len(ws.latencies) < windowSamplesKept {
+		ws.latencies = append(ws.latencies, latency)
+	} else if i := mathrand.Int64N(ws.requests); i < windowSamplesKept {
+		ws.latencies[i] = latency
+	}
+}
 
-		fmt.Printf("%sFlags%s\n", colorSection, colorReset)
-		flag.VisitAll(func(f *flag.Flag) {
-			fmt.Printf("  %s--%s%s %s%s%s\n",
-				colorHighlight, f.Name, colorReset,
-				colorDescription, f.Usage, colorReset,
-			)
-		})
-		fmt.Println()
+// logEvery prints a summary of each window and starts a fresh one, for visibility without a metrics backend.
+func (ws *windowStats) logEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		ws.mu.Lock()
+		requests, errors, latencies := ws.requests, ws.errors, ws.latencies
+		ws.requests, ws.errors, ws.latencies = 0, 0, nil
+		ws.mu.Unlock()
 
-		fmt.Printf("%sQuick Start%s\n", colorSection, colorReset)
-		fmt.Printf("  %sMinimal:%s chicha-http-proxy --target-url https://example.com\n", colorHighlight, colorReset)
-		fmt.Printf("  %sAdvanced:%s chicha-http-proxy --target-url https://example.com --http-port 8080 --domain proxy.example.com --https-port 8443\n", colorHighlight, colorReset)
-		fmt.Println()
+		if requests == 0 {
+			log.Printf("Stats for the last %s: requests=0", interval)
+			continue
+		}
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		log.Printf("Stats for the last %s: requests=%d errors=%d (%.1f%%) p50=%s p95=%s", interval, requests, errors,
+			100*float64(errors)/float64(requests), percentile(latencies, 50), percentile(latencies, 95))
+	}
+}
 
-		fmt.Printf("%sNotes%s\n", colorSection, colorReset)
-		fmt.Printf("  %s• Certificates fetched automatically when --domain is set.%s\n", colorDescription, colorReset)
-		fmt.Printf("  %s• Upstream TLS verification is disabled intentionally for trust-on-first-use scenarios.%s\n\n", colorDescription, colorReset)
+// percentile picks the nearest-rank value from sorted latencies.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (len(sorted)*p + 99) / 100
+	if rank < 1 {
+		rank = 1
 	}
+	return sorted[rank-1].Round(time.Microsecond)
+}
 
-	// Define command-line flags
-	httpPort := flag.String("http-port", "80", "Port for the HTTP server. If -domain is set, this is forced to 80.")
-	httpsPort := flag.String("https-port", "443", "Port for the HTTPS server (only used if -domain is set).")
-	targetURL := flag.String("target-url", "https://twochicks.ru", "Target URL for forwarding requests.")
-	domain := flag.String("domain", "", "Domain for automatic Let's Encrypt certificate. Forces HTTP port to 80 and admin rights, HTTPS can be changed.")
-	hostModeFlag := flag.String("host-mode", "domain", "Controls which host is forwarded upstream: 'domain' keeps the public name, 'target' preserves the backend host.")
-	showVersion := flag.Bool("version", false, "Show program version")
+// statsSnapshot is the JSON shape of /admin/stats.
+type statsSnapshot struct {
+	Since    time.Time            `json:"since"`
+	Requests int64                `json:"requests"`
+	Errors   int64                `json:"errors"`
+	Received int64                `json:"bytes_received"`
+	Sent     int64                `json:"bytes_sent"`
+	Statuses map[string]int64     `json:"statuses"`
+	Backends map[string]int64     `json:"backends"`
+	LastSeen map[string]time.Time `json:"last_seen"`
+	TLS      map[string]int64     `json:"tls"`
+	Recent   []errorEvent         `json:"recent_errors"`
+}
 
-	// Send log output to STDOUT so systemd captures it consistently.
-	log.SetOutput(os.Stdout)
+// snapshot copies the counters so encoding happens outside the lock.
+func (s *proxyStats) snapshot() statsSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snap := statsSnapshot{
+		Since:    s.since,
+		Requests: s.requests.Load(),
+		Errors:   s.errors.Load(),
+		Received: s.bytesReceived.Load(),
+		Sent:     s.bytesSent.Load(),
+		Statuses: make(map[string]int64, len(s.statuses)),
+		Backends: make(map[string]int64, len(s.backends)),
+		LastSeen: make(map[string]time.Time, len(s.lastSeen)),
+		TLS:      make(map[string]int64, len(s.tls)),
+		Recent:   append([]errorEvent{}, s.recent...),
+	}
+	for status, count := range s.statuses {
+		snap.Statuses[strconv.Itoa(status)] = count
+	}
+	for backend, count := range s.backends {
+		snap.Backends[backend] = count
+	}
+	for backend, seen := range s.lastSeen {
+		snap.LastSeen[backend] = seen
+	}
+	for params, count := range s.tls {
+		snap.TLS[params] = count
+	}
+	return snap
+}
 
-	// Parse the flags
-	flag.Parse()
+// statusRecorder remembers the status written to the client for counters and logs.
+// bytes, received, upstream and requestID feed the access log: body bytes sent and received, the last backend address tried,
+// and the correlation ID. received is atomic because a streamed request body is read by the transport's own goroutine.
+type statusRecorder struct {
+	http.ResponseWriter
+	status    int
+	bytes     int64
+	received  atomic.Int64
+	upstream  string
+	requestID string
+	// variant is the --canary-target split a request fell into, "stable" or "canary"; empty without a split.
+	variant string
+	// capture, when set, keeps a copy of the response for idempotency replays.
+	capture *responseCapture
+}
 
-	// If --version is specified, print the program version and exit
-	if *showVersion {
-		fmt.Printf("Program version: %s\n", version)
-		os.Exit(0)
+// WriteHeader records the status before passing it on.
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+		rec.capture.begin(status, rec.Header())
 	}
+	rec.ResponseWriter.WriteHeader(status)
+}
 
-	// The target URL must be specified.
-	if *targetURL == "" {
-		log.Fatal("Target URL (--target-url) is not specified")
+// Write records the implicit 200 when the handler writes without calling WriteHeader.
+func (rec *statusRecorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+		rec.capture.begin(http.StatusOK, rec.Header())
 	}
+	n, err := rec.ResponseWriter.Write(p)
+	rec.bytes += int64(n)
+	rec.capture.write(p[:n])
+	return n, err
+}
 
-	// If a domain is provided for certificate retrieval:
-	// - Force HTTP port to 80 (required for Let's Encrypt HTTP challenge).
-	// - Allow user to specify HTTPS port (default 443), if desired.
-	if *domain != "" {
-		*httpPort = "80"
-		log.Printf("Domain specified. HTTP port forced to 80. HTTPS port: %s", *httpsPort)
-	} else {
-		// If no domain is specified:
-		// - The user can use any HTTP port they like.
-		// - No HTTPS will be started as no certificate is requested.
-		fmt.Printf("No domain specified. Running HTTP on port %s only.\n", *httpPort)
+// Flush keeps streaming responses flushable through the wrapper.
+func (rec *statusRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
 	}
+}
 
-	parsedTarget, err := url.Parse(*targetURL)
-	if err != nil {
-		exitWithError("Failed to parse target URL", err)
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// responseCapture is a copy of one response as sent to the client, kept for idempotency replays.
+// Its methods accept a nil receiver so the recorder can call them whether or not capturing is on.
+type responseCapture struct {
+	limit  int
+	status int
+	header http.Header
+	body   bytes.Buffer
+	// unusable marks a response that must not be replayed: larger than limit, cut short, or abandoned by the client.
+	unusable bool
+}
+
+// begin snapshots the status and headers as they go out.
+func (c *responseCapture) begin(status int, header http.Header) {
+	if c == nil {
+		return
 	}
+	c.status, c.header = status, header.Clone()
+}
 
-	hostMode := hostFromDomain
-	switch *hostModeFlag {
-	case "domain":
-		hostMode = hostFromDomain
-	case "target":
-		hostMode = hostFromTarget
-	default:
-		exitWithError("Invalid host-mode value", fmt.Errorf("%s", *hostModeFlag))
+// write appends body bytes until the limit is exceeded.
+func (c *responseCapture) write(p []byte) {
+	if c == nil || c.unusable {
+		return
 	}
+	if c.body.Len()+len(p) > c.limit {
+		c.unusable, c.body = true, bytes.Buffer{}
+		return
+	}
+	c.body.Write(p)
+}
 
-	transport := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
-	handler := proxyHandler(proxyConfig{
-		targetURL:     *targetURL,
-		forwardedHost: *domain,
-		upstreamHost:  parsedTarget.Host,
-		hostMode:      hostMode,
-		transport:     transport,
-	})
+// discard keeps an incomplete response from being stored.
+func (c *responseCapture) discard() {
+	if c != nil {
+		c.unusable = true
+	}
+}
 
-	// errorChan collects startup/runtime issues from goroutines so we can surface them to systemd.
-	// Buffer keeps the channel writable even if two servers fail in quick succession during shutdown.
-	errorChan := make(chan error, 2)
+// idempotencyEntry is the response stored for one key. done closes once the first request has finished;
+// response stays nil if that outcome could not be stored. fingerprint identifies the first request's body.
+type idempotencyEntry struct {
+	done        chan struct{}
+	response    *responseCapture
+	expires     time.Time
+	fingerprint string
+}
 
-	// Start HTTP server. If a domain is given, this will always be on port 80.
-	// If no domain is given, this uses the user-specified port.
-	if *httpPort != "" {
-		go func() {
-			httpServer := &http.Server{
-				Addr:    ":" + *httpPort,
-				Handler: handler,
-			}
-			log.Printf("Starting HTTP proxy on port %s targeting %s", *httpPort, *targetURL)
-			if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-				wrappedErr := fmt.Errorf("HTTP server error: %w", err)
-				log.Printf("HTTP server failed: %v", err)
-				errorChan <- wrappedErr
-			}
-		}()
+// idempotencyCache coalesces requests that repeat an idempotency key: the first one is forwarded and its response kept
+// for ttl, while duplicates, concurrent or later, wait for and receive that response without reaching the backend.
+type idempotencyCache struct {
+	ttl        time.Duration
+	maxBody    int
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*idempotencyEntry
+}
+
+// newIdempotencyCache returns an empty cache and starts sweeping expired entries, at least once a minute so a long
+// ttl does not leave the cache holding expired keys for hours.
+func newIdempotencyCache(ttl time.Duration, maxBody, maxEntries int) *idempotencyCache {
+	cache := &idempotencyCache{ttl: ttl, maxBody: maxBody, maxEntries: maxEntries, entries: make(map[string]*idempotencyEntry)}
+	go cache.sweepEvery(min(ttl, time.Minute))
+	return cache
+}
+
+// idempotencyScope builds the cache key. The method, target and credentials are part of it, so a key reused for
+// another endpoint, or guessed by another user, never replays someone else's response.
+func idempotencyScope(r *http.Request, key string) string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{r.Method, r.Host, r.RequestURI, r.Header.Get("Authorization"), r.Header.Get("Cookie"), key}, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+// idempotencyFingerprint identifies the request body, so a key reused with a different payload is refused instead of
+// answered with the response to the first one. The body is hashed and put back for forwarding.
+func idempotencyFingerprint(r *http.Request) (string, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return r.Header.Get("Content-Type"), nil
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return "", err
 	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	sum := sha256.Sum256(append([]byte(r.Header.Get("Content-Type")+"\x00"), body...))
+	return hex.EncodeToString(sum[:]), nil
+}
 
-	// If a domain is specified, set up HTTPS with Let's Encrypt on the specified port.
-	if *domain != "" {
-		// Obtain the user's home directory to store certificates.
-		homeDir, err := os.UserHomeDir()
-		if err != nil {
-			exitWithError("Failed to get user home directory", err)
+// claim returns the entry for scope and whether the caller is the first request, which must forward and then finish it.
+// ok is false when the cache is full even after dropping expired entries; such requests are forwarded without deduplication.
+func (c *idempotencyCache) claim(scope, fingerprint string) (entry *idempotencyEntry, leader, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if entry, found := c.entries[scope]; found && (entry.expires.IsZero() || now.Before(entry.expires)) {
+		return entry, false, true
+	}
+	if len(c.entries) >= c.maxEntries {
+		c.sweep(now)
+		if len(c.entries) >= c.maxEntries {
+			return nil, false, false
 		}
+	}
+	entry = &idempotencyEntry{done: make(chan struct{}), fingerprint: fingerprint}
+	c.entries[scope] = entry
+	return entry, true, true
+}
 
-		// Setup the directory to store TLS certificates.
-		certDir := filepath.Join(homeDir, ".chicha-http-proxy-ssl-certs")
-		if err := os.MkdirAll(certDir, 0700); err != nil {
-			exitWithError("Failed to create cert directory", err)
+// finish stores the first request's response and releases the duplicates waiting for it.
+// 5xx answers are not stored, so a request that failed at the proxy or the backend can be retried with the same key,
+// and neither are 408, 409 and 429, which ask the client to try again rather than report an outcome.
+func (c *idempotencyCache) finish(scope string, entry *idempotencyEntry, response *responseCapture) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if response.status == 0 || response.status >= 500 || response.unusable || retryableStatus(response.status) {
+		if c.entries[scope] == entry {
+			delete(c.entries, scope)
 		}
+	} else {
+		entry.response = response
+		entry.expires = time.Now().Add(c.ttl)
+	}
+	close(entry.done)
+}
 
-		go func() {
-			m := &autocert.Manager{
-				Cache:      autocert.DirCache(certDir),
-				Prompt:     autocert.AcceptTOS,
-				HostPolicy: autocert.HostWhitelist(*domain),
-			}
+// sweepEvery drops expired entries so keys that are never repeated do not accumulate.
+func (c *idempotencyCache) sweepEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		c.mu.Lock()
+		c.sweep(time.Now())
+		c.mu.Unlock()
+	}
+}
 
-			httpsServer := &http.Server{
-				Addr:      ":" + *httpsPort,
-				TLSConfig: m.TLSConfig(),
-				Handler:   handler,
-			}
+// sweep drops the entries expired at now; the caller holds mu.
+func (c *idempotencyCache) sweep(now time.Time) {
+	for scope, entry := range c.entries {
+		if !entry.expires.IsZero() && now.After(entry.expires) {
+			delete(c.entries, scope)
+		}
+	}
+}
 
-			log.Printf("Starting HTTPS proxy on domain %s and port %s targeting %s", *domain, *httpsPort, *targetURL)
-			if err := httpsServer.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
-				wrappedErr := fmt.Errorf("HTTPS server error: %w", err)
-				log.Printf("HTTPS server failed: %v", err)
-				errorChan <- wrappedErr
-			}
-		}()
+// retryableStatus reports the client errors that mean "not now" rather than a final answer to the request.
+func retryableStatus(status int) bool {
+	return status == http.StatusRequestTimeout || status == http.StatusConflict || status == http.StatusTooManyRequests
+}
+
+// replayResponse answers a duplicate request with the stored response; the request ID stays the duplicate's own.
+func replayResponse(w http.ResponseWriter, response *responseCapture, requestIDHeader, requestID string) {
+	copyHeader(w.Header(), response.header)
+	if requestIDHeader != "" {
+		w.Header().Set(requestIDHeader, requestID)
 	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(response.status)
+	w.Write(response.body.Bytes())
+}
 
-	// Block until a goroutine reports an unrecoverable error so we can show it directly.
-	if err := <-errorChan; err != nil {
-		reportFatal(fmt.Sprintf("Fatal error: %v", err))
-		os.Exit(1)
+// countingBody counts request body bytes as they are read from the client, wherever the body ends up being consumed.
+type countingBody struct {
+	io.ReadCloser
+	count *atomic.Int64
+}
+
+// Read counts the bytes before handing them on.
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.count.Add(int64(n))
+	return n, err
+}
+
+// errorPageData is what the --bad-gateway-page template can render.
+type errorPageData struct {
+	Status     int
+	StatusText string
+	Message    string
+	RetryAfter int
+}
+
+// writeProxyError answers failures generated by the proxy itself.
+// 502 and 503 use the configured fallback page when present so public visitors see an explanation instead of a raw string.
+func writeProxyError(w http.ResponseWriter, cfg proxyConfig, status int, message string) {
+	cfg.stats.recordError(status, message)
+
+	// Every status that asks clients to come back later carries Retry-After so well-behaved clients back off during incidents.
+	if cfg.retryAfter > 0 && (status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusTooManyRequests) {
+		w.Header().Set("Retry-After", strconv.Itoa(cfg.retryAfter))
+	}
+
+	if cfg.errorPage == nil || (status != http.StatusBadGateway && status != http.StatusServiceUnavailable) {
+		writeErrorBody(w, cfg, status, message)
+		return
+	}
+
+	// Render into a buffer first so a broken template still yields a clean plain-text error.
+	var page bytes.Buffer
+	err := cfg.errorPage.Execute(&page, errorPageData{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Message:    message,
+		RetryAfter: cfg.retryAfter,
+	})
+	if err != nil {
+		log.Printf("Error rendering bad gateway page: %v", err)
+		http.Error(w, message, status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(page.Bytes())
+}
+
+// jsonError is the body of proxy-generated errors with --error-format=json.
+type jsonError struct {
+	Error     string `json:"error"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// writeErrorBody sends a bare error in the configured format: plain text by default, JSON for API gateways.
+func writeErrorBody(w http.ResponseWriter, cfg proxyConfig, status int, message string) {
+	if !cfg.jsonErrors {
+		http.Error(w, message, status)
+		return
+	}
+	body := jsonError{
+		Error:   strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_"),
+		Message: message,
+	}
+	// The handler always wraps the writer in a statusRecorder, which is where the request ID lives.
+	if rec, ok := w.(*statusRecorder); ok {
+		body.RequestID = rec.requestID
+	}
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		http.Error(w, message, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(append(encoded, '\n'))
+}
+
+// upstreamFailureStatus separates an unreachable backend (503) and a timeout (504) from one that answered badly or broke mid-exchange (502).
+func upstreamFailureStatus(err error) (int, string) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout, "Upstream timed out"
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return http.StatusServiceUnavailable, "Upstream unavailable"
+	}
+	// Every other error that reports a timeout is a 504 as well. Mostly that is --upstream-ttfb-timeout, for a backend
+	// that took the request and stalled, but it also covers a connection the kernel gave up on (ETIMEDOUT) after the
+	// dial, e.g. a backend or --upstream-proxy that stopped acknowledging while the request was being sent.
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return http.StatusGatewayTimeout, "Upstream timed out"
+	}
+	return http.StatusBadGateway, "Error forwarding request"
+}
+
+// alternateHost flips a hostname between its www and apex forms.
+func alternateHost(host string) string {
+	if apex, ok := strings.CutPrefix(host, "www."); ok {
+		return apex
+	}
+	return "www." + host
+}
+
+// canonicalRedirect returns the absolute URL a request should be redirected to under the --canonical-host mode.
+// IP literals and single-label names such as localhost are never rewritten because they have no www counterpart.
+func canonicalRedirect(r *http.Request, mode string) (string, bool) {
+	if mode == "" {
+		return "", false
+	}
+
+	host, port, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host, port = r.Host, ""
+	}
+	if net.ParseIP(host) != nil || !strings.Contains(host, ".") {
+		return "", false
+	}
+
+	isWWW := strings.HasPrefix(host, "www.")
+	if (mode == "apex" && !isWWW) || (mode == "www" && isWWW) {
+		return "", false
+	}
+
+	target := alternateHost(host)
+	if port != "" {
+		target = net.JoinHostPort(target, port)
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	// RequestURI keeps the path and query exactly as the client encoded them.
+	return scheme + "://" + target + r.URL.RequestURI(), true
+}
+
+// formatDeadline renders the time left until deadline in the format the backend expects.
+// grpc follows the Grpc-Timeout wire format, ms sends the remaining milliseconds, unix-ms the absolute deadline.
+func formatDeadline(format string, deadline time.Time) string {
+	remaining := time.Until(deadline)
+	if remaining < 0 {
+		remaining = 0
+	}
+	switch format {
+	case "grpc":
+		// Grpc-Timeout allows at most eight digits, so switch to seconds for very long budgets.
+		if ms := remaining.Milliseconds(); ms < 100000000 {
+			return strconv.FormatInt(ms, 10) + "m"
+		}
+		return strconv.FormatInt(int64(remaining/time.Second), 10) + "S"
+	case "unix-ms":
+		return strconv.FormatInt(deadline.UnixMilli(), 10)
+	default:
+		return strconv.FormatInt(remaining.Milliseconds(), 10)
+	}
+}
+
+// normalizePathPrefix gives prefixes a single leading slash and no trailing slash so joins never double or drop separators.
+func normalizePathPrefix(prefix string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return ""
+	}
+	return "/" + prefix
+}
+
+// statusBody is a --status-body replacement for upstream response bodies.
+type statusBody struct {
+	body        []byte
+	contentType string
+}
+
+// parseStatusBody parses a --status-body value: CODE=TEXT, or CODE=@PATH to read the body from a file whose
+// content type follows its extension.
+func parseStatusBody(value string) (int, statusBody, error) {
+	code, body, ok := strings.Cut(value, "=")
+	if !ok {
+		return 0, statusBody{}, fmt.Errorf("expected CODE=TEXT or CODE=@PATH, got %q", value)
+	}
+	status, err := strconv.Atoi(strings.TrimSpace(code))
+	if err != nil || status < 100 || status > 599 {
+		return 0, statusBody{}, fmt.Errorf("invalid status %q", code)
+	}
+	file, fromFile := strings.CutPrefix(body, "@")
+	if !fromFile {
+		return status, statusBody{body: []byte(body), contentType: "text/plain; charset=utf-8"}, nil
+	}
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return 0, statusBody{}, err
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(file))
+	if contentType == "" {
+		contentType = http.DetectContentType(content)
+	}
+	return status, statusBody{body: content, contentType: contentType}, nil
+}
+
+// replaceBody swaps the upstream body for the configured one, dropping the headers that described the original.
+// The short discarded body is drained so the connection can be reused.
+func (sb statusBody) replaceBody(resp *http.Response) {
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	for _, name := range []string{"Content-Encoding", "Content-Range", "Content-Md5", "Digest", "Etag", "Last-Modified", "Trailer"} {
+		resp.Header.Del(name)
+	}
+	resp.Trailer = nil
+	resp.Header.Set("Content-Type", sb.contentType)
+	resp.Header.Set("Content-Length", strconv.Itoa(len(sb.body)))
+	resp.Body = io.NopCloser(bytes.NewReader(sb.body))
+	resp.ContentLength = int64(len(sb.body))
+}
+
+// parseStatusRemap parses --remap-status pairs such as "500=502,418=503".
+func parseStatusRemap(list string) (map[int]int, error) {
+	remap := make(map[int]int)
+	for _, pair := range strings.Split(list, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		from, to, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected FROM=TO, got %q", pair)
+		}
+		fromStatus, err := strconv.Atoi(strings.TrimSpace(from))
+		if err != nil || fromStatus < 100 || fromStatus > 599 {
+			return nil, fmt.Errorf("invalid status %q", from)
+		}
+		toStatus, err := strconv.Atoi(strings.TrimSpace(to))
+		if err != nil || toStatus < 100 || toStatus > 599 {
+			return nil, fmt.Errorf("invalid status %q", to)
+		}
+		remap[fromStatus] = toStatus
+	}
+	return remap, nil
+}
+
+// headerLineCount counts header lines rather than distinct names, so thousands of repeats of one name are caught too.
+func headerLineCount(header http.Header) int {
+	count := 0
+	for _, values := range header {
+		count += len(values)
+	}
+	return count
+}
+
+// dotSegmentReplacer decodes percent-encoded dots, which RFC 3986 treats as plain unreserved characters,
+// so /a/%2e%2e/b cannot slip past dot-segment removal.
+var dotSegmentReplacer = strings.NewReplacer("%2e", ".", "%2E", ".")
+
+// cleanRequestPath removes dot segments (RFC 3986 section 5.2.4) and collapses duplicate slashes, keeping the
+// trailing slash of directory-like paths. Other escapes such as %2F are left alone: they are not separators.
+func cleanRequestPath(requestPath string) string {
+	decoded := dotSegmentReplacer.Replace(requestPath)
+	cleaned := path.Clean("/" + decoded)
+	if cleaned != "/" && (strings.HasSuffix(decoded, "/") || strings.HasSuffix(decoded, "/.") || strings.HasSuffix(decoded, "/..")) {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// applyTrailingSlash adds or removes the trailing slash under the --trailing-slash policy and reports whether the path changed.
+// The root path is left alone, "add" skips paths whose last segment looks like a file (style.css), and results starting
+// with "//" are refused because browsers would read them as a protocol-relative redirect to another host.
+func applyTrailingSlash(requestPath, policy string) (string, bool) {
+	if requestPath == "" || requestPath == "/" {
+		return requestPath, false
+	}
+
+	var normalized string
+	switch policy {
+	case "add":
+		if strings.HasSuffix(requestPath, "/") || strings.Contains(path.Base(requestPath), ".") {
+			return requestPath, false
+		}
+		normalized = requestPath + "/"
+	case "remove":
+		normalized = strings.TrimRight(requestPath, "/")
+		if normalized == "" {
+			normalized = "/"
+		}
+	default:
+		return requestPath, false
+	}
+
+	if normalized == requestPath || strings.HasPrefix(normalized, "//") {
+		return requestPath, false
+	}
+	return normalized, true
+}
+
+// rewritePath strips and then adds the configured prefixes.
+// The boolean reports whether the strip prefix matched so the caller can decide between passthrough and 404.
+func rewritePath(requestPath string, cfg proxyConfig) (string, bool) {
+	if requestPath == "" {
+		requestPath = "/"
+	}
+
+	matched := true
+	if cfg.stripPathPrefix != "" {
+		// Match whole segments only so /api does not swallow the start of /apiary.
+		switch {
+		case requestPath == cfg.stripPathPrefix:
+			requestPath = "/"
+		case strings.HasPrefix(requestPath, cfg.stripPathPrefix+"/"):
+			requestPath = requestPath[len(cfg.stripPathPrefix):]
+		default:
+			matched = false
+		}
+	}
+
+	if cfg.addPathPrefix != "" {
+		requestPath = cfg.addPathPrefix + requestPath
+	}
+	return requestPath, matched
+}
+
+// proxyHandler returns an HTTP handler function that forwards incoming requests to a specified target URL (reverse proxy functionality).
+func proxyHandler(cfg proxyConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		w = recorder
+		// Bytes are counted as they cross the client connection, so compressed bodies count at their compressed size.
+		// http.NoBody stays unwrapped because later checks compare against it.
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = &countingBody{ReadCloser: r.Body, count: &recorder.received}
+		}
+		defer func() {
+			cfg.stats.recordStatus(recorder.status)
+			cfg.stats.recordBytes(recorder.received.Load(), recorder.bytes)
+			if cfg.window != nil {
+				cfg.window.observe(recorder.status, time.Since(start))
+			}
+			if cfg.accessLogFormat != "" {
+				accessLogger.Print(formatAccessLog(cfg.accessLogFormat, r, recorder, start))
+			}
+			if cfg.accessLogJSON != nil {
+				writeAccessRecord(cfg.accessLogJSON, r, recorder, start)
+			}
+		}()
+
+		// Every error line carries this ID; forwarding it lets backend and client logs be joined to ours.
+		requestID := incomingRequestID(r, cfg.requestIDHeader)
+		if requestID == "" {
+			requestID = newRequestID()
+		}
+		recorder.requestID = requestID
+		if cfg.requestIDHeader != "" {
+			w.Header().Set(cfg.requestIDHeader, requestID)
+		}
+
+		// TLS parameters are counted for every HTTPS request; logging them is opt-in because it doubles log volume.
+		if r.TLS != nil {
+			cfg.stats.recordTLS(r.TLS)
+			if cfg.logTLS {
+				log.Printf("TLS version=%q cipher=%s sni=%q client=%s", tls.VersionName(r.TLS.Version), tls.CipherSuiteName(r.TLS.CipherSuite), r.TLS.ServerName, r.RemoteAddr)
+			}
+		}
+
+		// Oversized URIs and header floods are mostly scanners or attempts to hit stricter backend limits; refuse them before anything else runs.
+		if cfg.maxURILength > 0 && len(r.RequestURI) > cfg.maxURILength {
+			writeErrorBody(w, cfg, http.StatusRequestURITooLong, "URI Too Long")
+			return
+		}
+		if cfg.maxHeaderCount > 0 && headerLineCount(r.Header) > cfg.maxHeaderCount {
+			writeErrorBody(w, cfg, http.StatusRequestHeaderFieldsTooLarge, "Request Header Fields Too Large")
+			return
+		}
+
+		// Redirects, X-Forwarded-Host and backend-generated links are built from Host, so unexpected values are refused outright.
+		if len(cfg.allowedHosts) > 0 && !hostAllowed(r.Host, cfg.allowedHosts) {
+			writeErrorBody(w, cfg, http.StatusBadRequest, "Unknown Host")
+			return
+		}
+
+		// CORS preflights for a policy kept at the edge are answered here, sparing the backend a round trip per preflight.
+		// This runs before the canonical redirect because browsers refuse to follow redirects of preflight requests.
+		if cfg.optionsHeaders != nil && r.Method == http.MethodOptions {
+			for name, values := range cfg.optionsHeaders {
+				w.Header()[name] = append([]string(nil), values...)
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		// Canonicalise the hostname before doing any work so search engines only ever index one form.
+		if location, ok := canonicalRedirect(r, cfg.canonicalHost); ok {
+			http.Redirect(w, r, location, http.StatusMovedPermanently)
+			return
+		}
+
+		// Path-based decisions below must see the path the backend will resolve, or /public/../admin and //admin
+		// could pass a prefix check aimed at /admin. Route-only mode still forwards the client's original spelling.
+		requestPath := r.URL.EscapedPath()
+		clientPath := requestPath
+		if cfg.normalizePath {
+			requestPath = cleanRequestPath(requestPath)
+			r.URL.Path = cleanRequestPath(r.URL.Path)
+		}
+
+		// Normalise the trailing slash the backend expects; redirecting teaches clients and caches the right URL once.
+		if normalized, changed := applyTrailingSlash(requestPath, cfg.trailingSlash); changed {
+			if !cfg.trailingSlashRewrite {
+				location := normalized
+				if r.URL.RawQuery != "" {
+					location += "?" + r.URL.RawQuery
+				}
+				// 308 keeps the method and body for non-idempotent requests, which a 301 would let clients turn into GET.
+				status := http.StatusMovedPermanently
+				if r.Method != http.MethodGet && r.Method != http.MethodHead {
+					status = http.StatusPermanentRedirect
+				}
+				http.Redirect(w, r, location, status)
+				return
+			}
+			requestPath = normalized
+		}
+
+		// Clients limited to GET and POST (HTML forms, old SDKs) reach RESTful backends through an override; the backend sees the real verb.
+		method, rawQuery := r.Method, r.URL.RawQuery
+		if cfg.methodOverrideHeader != "" && r.Method == http.MethodPost {
+			override, query, err := methodOverride(r, cfg.methodOverrideHeader)
+			if err != nil {
+				writeErrorBody(w, cfg, http.StatusBadRequest, "Unsupported method override")
+				log.Printf("Error overriding method [%s]: %v", describeRequest(r, requestID), err)
+				return
+			}
+			method, rawQuery = override, query
+		}
+
+		// --strip-path-prefix is the route: a path outside it goes to --default-target when there is one, and is
+		// otherwise forwarded unchanged or refused, as --strip-prefix-miss says.
+		_, routed := rewritePath(requestPath, cfg)
+		if !routed && cfg.defaultTargetURL == "" && cfg.rejectPrefixMiss {
+			writeErrorBody(w, cfg, cfg.noRouteStatus, http.StatusText(cfg.noRouteStatus))
+			return
+		}
+
+		// Chaos-testing faults run before any upstream work so a delayed request behaves like a slow backend and an aborted one never reaches it.
+		if cfg.faultDelayPercent > 0 && mathrand.IntN(100) < cfg.faultDelayPercent {
+			timer := time.NewTimer(cfg.faultDelay)
+			select {
+			case <-timer.C:
+			case <-r.Context().Done():
+				timer.Stop()
+				return
+			}
+		}
+		if cfg.faultAbortPercent > 0 && mathrand.IntN(100) < cfg.faultAbortPercent {
+			writeProxyError(w, cfg, cfg.faultAbortStatus, "Injected fault")
+			return
+		}
+
+		// Double-submitted payments and orders are answered from the first attempt instead of running twice.
+		// Duplicates that arrive while the first is still in flight wait for its outcome rather than racing it.
+		if cfg.idempotency != nil && (r.Method == http.MethodPost || r.Method == http.MethodPatch) {
+			if key := r.Header.Get(cfg.idempotencyHeader); key != "" {
+				scope := idempotencyScope(r, key)
+				fingerprint, err := idempotencyFingerprint(r)
+				if err != nil {
+					writeProxyError(w, cfg, http.StatusInternalServerError, "Failed to read request body")
+					log.Printf("Error reading request body [%s]: %v", describeRequest(r, requestID), err)
+					return
+				}
+			claiming:
+				for {
+					entry, leader, ok := cfg.idempotency.claim(scope, fingerprint)
+					if ok && !leader && entry.fingerprint != fingerprint {
+						writeErrorBody(w, cfg, http.StatusUnprocessableEntity, "Idempotency key reused with a different request body")
+						log.Printf("Rejecting repeated %s with a different body [%s]", cfg.idempotencyHeader, describeRequest(r, requestID))
+						return
+					}
+					switch {
+					case !ok:
+						log.Printf("WARNING: idempotency cache full, forwarding without deduplication [%s]", describeRequest(r, requestID))
+						break claiming
+					case leader:
+						recorder.capture = &responseCapture{limit: cfg.idempotency.maxBody}
+						defer func() {
+							// A client that left mid-response may have cut the copy short as well.
+							if r.Context().Err() != nil {
+								recorder.capture.discard()
+							}
+							cfg.idempotency.finish(scope, entry, recorder.capture)
+						}()
+						break claiming
+					}
+					select {
+					case <-entry.done:
+					case <-r.Context().Done():
+						return
+					}
+					if entry.response != nil {
+						log.Printf("Replaying response for repeated %s [%s]", cfg.idempotencyHeader, describeRequest(r, requestID))
+						replayResponse(w, entry.response, cfg.requestIDHeader, requestID)
+						return
+					}
+					// The first attempt failed or could not be stored. The waiters claim the key again, so exactly one
+					// of them is forwarded as the next first request and the rest keep waiting for its outcome.
+				}
+			}
+		}
+
+		targetURL, upstreamHost, upstreamUser := cfg.targetURL, cfg.upstreamHost, cfg.upstreamUser
+		defaultRoute := !routed && cfg.defaultTargetURL != ""
+		if defaultRoute {
+			targetURL, upstreamHost, upstreamUser = cfg.defaultTargetURL, cfg.defaultTargetHost, cfg.defaultTargetUser
+		}
+
+		// Requests sharing a hash key always reach the same backend, so each backend cache only holds its share of the keys.
+		// Requests without the header take the usual route below; the hash and canary splits only divide routed paths.
+		hashed := false
+		if cfg.hashRing != nil && !defaultRoute {
+			if key := r.Header.Get(cfg.hashHeader); key != "" {
+				backend := cfg.hashRing.pick(key)
+				targetURL, upstreamHost, upstreamUser = backend.target, backend.host, backend.user
+				hashed = true
+			}
+		}
+
+		// Canary routing is deterministic per client so a user never flips between variants mid-session.
+		if cfg.canaryURL != "" && !hashed && !defaultRoute {
+			// The variant goes to the access log, next to the request ID, rather than to a line of its own.
+			recorder.variant = "stable"
+			if canaryBucket(canaryClientID(r, cfg.canaryCookie)) < cfg.canaryPercent {
+				recorder.variant = "canary"
+				targetURL, upstreamHost, upstreamUser = cfg.canaryURL, cfg.canaryHost, cfg.canaryUser
+			}
+		}
+
+		// Engineers reproducing an issue may pin a request to one backend instance, but only from trusted networks.
+		// Credentials from --target-url belong to the configured backend and are never sent to an override.
+		if override := r.Header.Get(backendOverrideHeader); override != "" && cfg.backendOverride && ipInNetworks(remoteIP(r), cfg.trustedProxies) {
+			backend, err := parseBackendOverride(override)
+			if err != nil {
+				writeErrorBody(w, cfg, http.StatusBadRequest, "Invalid "+backendOverrideHeader+" header")
+				log.Printf("Error parsing %s [%s]: %v", backendOverrideHeader, describeRequest(r, requestID), err)
+				return
+			}
+			targetURL, upstreamHost, upstreamUser = strings.TrimSuffix(backend.String(), "/"), backend.Host, nil
+			log.Printf("Backend override from %s: %s %s -> %s", r.RemoteAddr, r.Method, r.URL.Path, targetURL)
+		}
+
+		// Audited bodies are copied as they are read, whether buffered below or streamed upstream, so auditing adds no extra pass.
+		if cfg.auditLog != nil && r.Body != nil && r.Body != http.NoBody && matchesAuditPath(r.URL.Path, cfg.auditPaths) {
+			captured := &cappedBuffer{limit: cfg.auditMaxBody}
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.TeeReader(r.Body, captured), r.Body}
+			defer writeAuditRecord(cfg, r, requestID, captured)
+		}
+
+		// Attempt to read the request body (if present)
+		// Buffering lets redirects replay the body; --forward-headers-only gives that up to keep large uploads out of memory.
+		var body []byte
+		if r.Body != nil && !cfg.forwardHeadersOnly {
+			var err error
+			body, err = io.ReadAll(r.Body)
+			if err != nil {
+				writeProxyError(w, cfg, http.StatusInternalServerError, "Failed to read request body")
+				log.Printf("Error reading request body [%s]: %v", describeRequest(r, requestID), err)
+				return
+			}
+		}
+
+		// Compressing clients can talk to backends that only understand identity bodies; the upstream request then
+		// carries the decoded bytes with a matching Content-Length and no Content-Encoding.
+		bodyDecoded := false
+		if cfg.decompressRequest && len(body) > 0 {
+			decoded, err := decodeRequestBody(body, r.Header.Get("Content-Encoding"), cfg.maxDecompressedBody)
+			switch {
+			case errors.Is(err, errDecodedBodyTooLarge):
+				writeErrorBody(w, cfg, http.StatusRequestEntityTooLarge, "Decompressed request body too large")
+				log.Printf("Error decompressing request body [%s]: %v", describeRequest(r, requestID), err)
+				return
+			case err != nil:
+				writeErrorBody(w, cfg, http.StatusBadRequest, "Malformed compressed request body")
+				log.Printf("Error decompressing request body [%s]: %v", describeRequest(r, requestID), err)
+				return
+			case decoded != nil:
+				body, bodyDecoded = decoded, true
+			}
+		}
+
+		// Apply the global prefix rules before anything else so redirects and logs reflect the backend path.
+		// Working on the escaped path keeps %2F, encoded spaces and semicolons byte-identical to what the client sent.
+		forwardPath, _ := rewritePath(requestPath, cfg)
+		if cfg.normalizeRouteOnly {
+			forwardPath, _ = rewritePath(clientPath, cfg)
+		}
+		// The default target has its own URL space, so it gets the path without --add-path-prefix.
+		if defaultRoute {
+			forwardPath = requestPath
+			if cfg.normalizeRouteOnly {
+				forwardPath = clientPath
+			}
+		}
+
+		// Construct the initial forwarding URL by combining the target URL with the rewritten path
+		originalURL := targetURL + forwardPath
+		currentURL := originalURL
+
+		// Cookies set by redirects the proxy follows internally are replayed on the final response.
+		var redirectCookies []string
+
+		// redirects counts followed hops; sendBody turns false once a 301/302/303 has turned the request into a GET.
+		redirects, sendBody := 0, true
+		// retried counts transport failures already retried for this request, across all hops.
+		retried := 0
+
+		// Upstream latency starts once the client body is in hand so slow uploads are not blamed on the backend.
+		upstreamStart := time.Now()
+
+		// The timeout covers every redirect hop and the body copy, so the deadline we advertise is the one we enforce.
+		// It follows the backend chosen above, whether by the listener, the canary split or an override.
+		ctx := r.Context()
+		timeout := cfg.upstreamTimeout
+		if backendTimeout, ok := cfg.backendTimeouts[strings.ToLower(upstreamHost)]; ok {
+			timeout = backendTimeout
+		}
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+
+		// Connection phases are only visible through httptrace; reused pooled connections simply report none.
+		var timing *phaseTimings
+		if cfg.serverTiming {
+			timing = &phaseTimings{}
+			ctx = httptrace.WithClientTrace(ctx, timing.trace())
+		}
+
+		for {
+			// Create a new outgoing request using the incoming request's method, headers, and body.
+			// Binding to the client's context cancels the upstream exchange as soon as the client goes away.
+			requestBody := upstreamBody(body)
+			if cfg.forwardHeadersOnly {
+				requestBody = streamedBody(r)
+			}
+			if !sendBody {
+				requestBody = http.NoBody
+			}
+			// Each hop can be cancelled on its own: the transport then fails the read of the raw body, and the transform
+			// wrappers above it only see that error, so no reader is ever closed under a concurrent Read.
+			hopCtx, cancelHop := context.WithCancel(ctx)
+			defer cancelHop()
+			// A followed chain has a total deadline of its own even without --upstream-timeout, counted from the first
+			// request until the final hop's headers arrive; the body that follows is not limited by it.
+			var redirectTimer *time.Timer
+			var redirectExpired atomic.Bool
+			if redirects > 0 {
+				redirectTimer = time.AfterFunc(time.Until(upstreamStart.Add(cfg.redirectTimeout)), func() {
+					redirectExpired.Store(true)
+					cancelHop()
+				})
+			}
+			req, err := http.NewRequestWithContext(hopCtx, method, currentURL, requestBody)
+			if err != nil {
+				writeProxyError(w, cfg, http.StatusInternalServerError, "Failed to create request")
+				log.Printf("Error creating request [%s]: %v", describeRequest(r, requestID), err)
+				return
+			}
+			// Transports that treat the chosen backend specially, such as --upstream-h2c, must not extend that to redirect hops.
+			if strings.EqualFold(req.URL.Host, upstreamHost) {
+				req = req.WithContext(context.WithValue(req.Context(), routedBackendKey{}, true))
+			}
+			// A known length goes out as Content-Length; -1 (a chunked upload) stays chunked towards the backend.
+			if cfg.forwardHeadersOnly && requestBody != http.NoBody {
+				req.ContentLength = r.ContentLength
+			}
+
+			// Copy all headers from the incoming request to the outgoing request.
+			copyHeader(req.Header, r.Header)
+			if !sendBody {
+				req.Header.Del("Content-Type")
+				req.Header.Del("Content-Encoding")
+			}
+			if bodyDecoded {
+				req.Header.Del("Content-Encoding")
+			}
+			// Connection semantics belong to each hop: an HTTP/1.0 client's "Connection: keep-alive" says nothing about the upstream link.
+			removeHopByHopHeaders(req.Header)
+			// The override is a routing instruction for this proxy, not something the backend should see or trust.
+			req.Header.Del(backendOverrideHeader)
+			if cfg.requestIDHeader != "" {
+				req.Header.Set(cfg.requestIDHeader, requestID)
+			}
+			if cfg.methodOverrideHeader != "" {
+				req.Header.Del(cfg.methodOverrideHeader)
+			}
+			// Backends authorise on these headers, so only the TLS handshake may fill them, never the client.
+			if cfg.forwardClientCert {
+				setClientCertHeaders(req.Header, r.TLS, cfg.forwardClientCertPEM)
+			}
+
+			// Populate X-Forwarded-* headers so the upstream can recover client context.
+			// Using Set ensures we do not accumulate duplicates if the client already supplied values.
+			forwardedFor := r.RemoteAddr
+			if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+				forwardedFor = host
+			}
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+
+			// The listener that accepted the request decides the scheme: only the HTTPS server hands us a TLS connection state.
+			// Backends rely on this for redirect generation and secure cookies, so it must not claim https for plain HTTP traffic.
+			forwardedProto := "http"
+			if r.TLS != nil {
+				forwardedProto = "https"
+			}
+			req.Header.Set("X-Forwarded-Proto", forwardedProto)
+
+			// Determine which host should be visible to the upstream based on the configured strategy.
+			// Keeping this centralised avoids subtle header divergence across Host and X-Forwarded-Host.
+			backendHost := cfg.forwardedHost
+			if backendHost == "" || cfg.hostMode == hostFromTarget {
+				backendHost = upstreamHost
+			}
+
+			forwardedHost := cfg.forwardedHost
+			if forwardedHost == "" {
+				forwardedHost = backendHost
+			}
+
+			// Enforce Host headers so origin servers and logs observe the configured host while X-Forwarded-Host keeps the public entry point when required.
+			req.Host = backendHost
+			req.Header.Set("Host", backendHost)
+			req.Header.Set("X-Forwarded-Host", forwardedHost)
+
+			// Backends behind their own basic auth get the credentials from --target-url on every request,
+			// but never a host that a redirect pointed us to.
+			if upstreamUser != nil && strings.EqualFold(req.URL.Host, upstreamHost) {
+				password, _ := upstreamUser.Password()
+				req.SetBasicAuth(upstreamUser.Username(), password)
+			}
+
+			// Identify this hop as RFC 9110 asks of intermediaries; Add keeps any Via entries from earlier proxies.
+			if cfg.viaName != "" {
+				req.Header.Add("Via", fmt.Sprintf("%d.%d %s", r.ProtoMajor, r.ProtoMinor, cfg.viaName))
+			}
+			if cfg.forwardedServer != "" {
+				req.Header.Set("X-Forwarded-Server", cfg.forwardedServer)
+			}
+
+			// Let deadline-aware backends shed work the proxy will give up on anyway.
+			if deadline, ok := ctx.Deadline(); ok && cfg.deadlineHeader != "" {
+				req.Header.Set(cfg.deadlineHeader, formatDeadline(cfg.deadlineFormat, deadline))
+			}
+
+			// Preserve the query string parameters; redirect hops keep the query their Location names.
+			if redirects == 0 {
+				req.URL.RawQuery = rawQuery
+			}
+
+			if cfg.logHeaders {
+				log.Printf("Upstream request headers %s %s: %s", req.Method, req.URL.Path, formatHeaders(req.Header, cfg.redactHeaders))
+			}
+
+			// Perform the HTTP request to the target server
+			recorder.upstream = req.URL.Host
+			resp, err := cfg.client.Do(req)
+			upstreamLatency := time.Since(upstreamStart)
+			// A timer that fired after the headers arrived has still cancelled the body, so that counts as expired too.
+			if redirectTimer != nil && !redirectTimer.Stop() && redirectExpired.Load() {
+				if err == nil {
+					resp.Body.Close()
+				}
+				err = fmt.Errorf("redirects not answered within --redirect-timeout %s: %w", cfg.redirectTimeout, context.DeadlineExceeded)
+			}
+			if err != nil {
+				if r.Context().Err() != nil {
+					log.Printf("Client closed connection before upstream responded [%s]", describeRequest(r, requestID))
+					return
+				}
+				// A streamed body cannot be sent twice; a buffered one can, so only the transport failure decides.
+				replayable := !cfg.forwardHeadersOnly || req.Body == nil || req.Body == http.NoBody
+				if retried < cfg.retries && replayable && ctx.Err() == nil && retryableFailure(err, req.Method) {
+					delay := retryDelay(retried, cfg.retryBase, cfg.retryMax, cfg.retryJitter)
+					retried++
+					log.Printf("Retrying in %s (%d of %d) [%s]: %v", delay.Round(time.Millisecond), retried, cfg.retries, describeRequest(r, requestID), err)
+					timer := time.NewTimer(delay)
+					select {
+					case <-timer.C:
+						continue
+					case <-ctx.Done():
+						timer.Stop()
+						err = ctx.Err()
+					}
+				}
+				if r.Context().Err() != nil {
+					log.Printf("Client closed connection before upstream responded [%s]", describeRequest(r, requestID))
+					return
+				}
+				cfg.health.failure(req.URL.Scheme+"://"+req.URL.Host, err)
+				status, message := upstreamFailureStatus(err)
+				writeProxyError(w, cfg, status, message)
+				log.Printf("Error forwarding request [%s]: %v", describeRequest(r, requestID), err)
+				return
+			}
+			defer resp.Body.Close()
+			cfg.health.success(req.URL.Scheme + "://" + req.URL.Host)
+
+			if cfg.logHeaders {
+				log.Printf("Upstream response headers %s %s %d: %s", req.Method, req.URL.Path, resp.StatusCode, formatHeaders(resp.Header, cfg.redactHeaders))
+			}
+
+			// If the response is a redirect (3xx with a Location), follow it.
+			// Location-less 3xx such as 304 Not Modified must reach the client so its conditional revalidation keeps working.
+			// 301, 302 and 303 continue as GET without a body, like browsers do; 307 and 308 resend method and body,
+			// which a streamed body cannot do once consumed, so those redirects go to the client instead.
+			keepsBody := resp.StatusCode == http.StatusTemporaryRedirect || resp.StatusCode == http.StatusPermanentRedirect
+			bodyConsumed := keepsBody && cfg.forwardHeadersOnly && req.Body != nil && req.Body != http.NoBody
+			if cfg.maxRedirects > 0 && resp.StatusCode >= 300 && resp.StatusCode < 400 && resp.Header.Get("Location") != "" && !bodyConsumed {
+				location, err := resp.Location()
+				if err != nil {
+					writeProxyError(w, cfg, http.StatusInternalServerError, "Failed to handle redirect")
+					log.Printf("Error handling redirect [%s]: %v", describeRequest(r, requestID), err)
+					return
+				}
+				if redirects++; redirects > cfg.maxRedirects {
+					writeProxyError(w, cfg, http.StatusBadGateway, "Too many upstream redirects")
+					log.Printf("Error following redirects [%s]: stopped after %d redirects", describeRequest(r, requestID), cfg.maxRedirects)
+					return
+				}
+				if !keepsBody && method != http.MethodGet && method != http.MethodHead {
+					method, sendBody = http.MethodGet, false
+				}
+				// Login flows typically set the session cookie on the 302 itself; following the redirect here must not lose it.
+				// Only the backend may set cookies: the client stores them for the proxy's domain, so a foreign host
+				// the backend redirected to could otherwise plant cookies there.
+				if strings.EqualFold(resp.Request.URL.Host, upstreamHost) {
+					redirectCookies = append(redirectCookies, resp.Header.Values("Set-Cookie")...)
+				}
+				// The redirect body is small or empty; closing it now hands the connection back for the next hop.
+				io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+				resp.Body.Close()
+				currentURL = location.String()
+				log.Printf("Redirecting to: %s", currentURL)
+				continue
+			}
+
+			// Headers are in but no body byte has moved, so this is where behaviour can branch on what the backend returned.
+			// Responses no transform claims, compressed or not, stream through untouched.
+			if len(cfg.transforms) > 0 && r.Method != http.MethodHead {
+				mediaType := responseMediaType(resp)
+				for _, transform := range cfg.transforms {
+					if !transform.matches(mediaType) {
+						continue
+					}
+					if err := transform.apply(resp, r); errors.Is(err, errTransformSkipped) {
+						log.Printf("Error applying %s, passing the body through [%s]: %v", transform.name, describeRequest(r, requestID), err)
+					} else if err != nil {
+						if r.Context().Err() != nil {
+							log.Printf("Client closed connection before upstream responded [%s]", describeRequest(r, requestID))
+							return
+						}
+						status, message := upstreamFailureStatus(err)
+						writeProxyError(w, cfg, status, message)
+						log.Printf("Error applying %s [%s]: %v", transform.name, describeRequest(r, requestID), err)
+						return
+					}
+				}
+			}
+
+			// Buffering drains the backend at its own pace and returns the connection to the pool before a slow client reads a byte.
+			// It also means a broken upstream body still yields a clean error instead of a truncated response.
+			if cfg.bufferResponses {
+				buffered, err := io.ReadAll(resp.Body)
+				if err != nil {
+					if r.Context().Err() != nil {
+						log.Printf("Client closed connection before upstream responded [%s]", describeRequest(r, requestID))
+						return
+					}
+					status, message := upstreamFailureStatus(err)
+					writeProxyError(w, cfg, status, message)
+					log.Printf("Error reading response body [%s]: %v", describeRequest(r, requestID), err)
+					return
+				}
+				resp.Body.Close()
+				resp.Body = io.NopCloser(bytes.NewReader(buffered))
+				resp.ContentLength = int64(len(buffered))
+			}
+
+			cfg.stats.recordBackend(resp.Request.URL.Host)
+
+			// The replacement is looked up by the upstream status, so a stack trace behind a 500 stays hidden even when
+			// --remap-status turns it into a 502.
+			override, overridden := cfg.statusBodies[resp.StatusCode]
+			if overridden {
+				override.replaceBody(resp)
+			}
+
+			// Translate the status before anything is written so clients and load balancers only ever see the mapped code.
+			if remapped, ok := cfg.statusRemap[resp.StatusCode]; ok {
+				if cfg.remapStatusBody && !overridden {
+					// The upstream body and headers describe the original status, so replace them together. This is still the
+					// backend's answer, so it is written here rather than through writeProxyError: stats and the error page,
+					// Retry-After and JSON framing stay reserved for errors the proxy generated itself.
+					w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+					w.Header().Set("X-Content-Type-Options", "nosniff")
+					applySecurityHeaders(w.Header(), cfg.securityHeaders, r.TLS != nil)
+					w.WriteHeader(remapped)
+					io.WriteString(w, http.StatusText(remapped)+"\n")
+					return
+				}
+				resp.StatusCode = remapped
+			}
+
+			// Copy the response headers from the target server to the client
+			if !strings.EqualFold(resp.Request.URL.Host, upstreamHost) {
+				resp.Header.Del("Set-Cookie")
+			}
+			for _, cookie := range redirectCookies {
+				w.Header().Add("Set-Cookie", cookie)
+			}
+			// The upstream's keep-alive decisions must not leak to the client; net/http frames the client connection
+			// for its protocol version, e.g. closing after the body for HTTP/1.0 clients that did not ask for keep-alive.
+			removeHopByHopHeaders(resp.Header)
+			copyHeader(w.Header(), resp.Header)
+			// Backends that echo the request ID would otherwise make it appear twice.
+			if cfg.requestIDHeader != "" {
+				w.Header().Set(cfg.requestIDHeader, requestID)
+			}
+			// Filtering the client-bound headers also covers cookies collected from followed redirects.
+			filterResponseHeaders(w.Header(), cfg.stripResponseHeaders, cfg.allowResponseHeaders)
+			applySecurityHeaders(w.Header(), cfg.securityHeaders, r.TLS != nil)
+			// Added after the upstream's own Server-Timing entries so devtools show both side by side.
+			if timing != nil {
+				w.Header().Add("Server-Timing", timing.header(upstreamStart.Sub(start), upstreamLatency))
+			}
+
+			// The soft deadline only applies to bodies of unknown length: they are chunked, so the client can be told about
+			// truncation in a trailer, whereas cutting a Content-Length body short would look like a broken connection.
+			var truncated atomic.Bool
+			if cfg.softTimeout > 0 && resp.ContentLength == -1 && r.Method != http.MethodHead {
+				w.Header().Add("Trailer", truncatedTrailer)
+				softTimer := time.AfterFunc(cfg.softTimeout-time.Since(upstreamStart), func() {
+					truncated.Store(true)
+					cancelHop()
+				})
+				defer softTimer.Stop()
+			}
+
+			// Nothing has reached the client until the first body chunk is written, so a body of known length that breaks
+			// from the start (a connection reset right after the headers) still gets a clean 502 instead of the upstream
+			// status. Bodies of unknown length are not waited for: event streams, long polls and gRPC streams send their
+			// headers and then idle, and the client must see those headers at once.
+			var head []byte
+			if r.Method != http.MethodHead && resp.ContentLength > 0 {
+				var err error
+				head, err = readFirstChunk(resp.Body)
+				if err != nil && r.Context().Err() == nil && !truncated.Load() {
+					clear(w.Header())
+					if cfg.requestIDHeader != "" {
+						w.Header().Set(cfg.requestIDHeader, requestID)
+					}
+					writeProxyError(w, cfg, http.StatusBadGateway, "Malformed upstream response")
+					log.Printf("Error reading response body [%s]: %v", describeRequest(r, requestID), err)
+					return
+				}
+			}
+
+			// Set the status code in the client response
+			w.WriteHeader(resp.StatusCode)
+
+			// Stream the response body; a client disconnect cancels the request context, which also aborts the upstream read.
+			// HEAD answers never carry a body, even from an upstream that wrongly sends one; the copied Content-Length
+			// still describes the body a GET would return, as RFC 9110 allows.
+			if r.Method == http.MethodHead {
+				resp.Body.Close()
+			} else if err := streamResponse(w, resp, head); err != nil || truncated.Load() {
+				// A --response-filter-cmd process sees the cancelled read as the end of its input and may finish its
+				// output cleanly, so the soft deadline counts even when the copy itself reports no error.
+				switch {
+				case r.Context().Err() != nil:
+					log.Printf("Client closed connection during the response [%s]", describeRequest(r, requestID))
+					return
+				case truncated.Load():
+					// Cancelling the hop is how the soft deadline stops the read, so this is the expected outcome rather than a failure.
+					w.Header().Set(truncatedTrailer, "soft-timeout")
+					recorder.capture.discard()
+					log.Printf("Soft timeout truncated response after %s [%s]", cfg.softTimeout, describeRequest(r, requestID))
+				default:
+					// Returning normally would end a chunked response with a valid terminator and keep the connection alive,
+					// so the client would take the partial body for a whole one. Aborting closes the connection (or resets
+					// the HTTP/2 stream) instead, which every client reports as a truncated response.
+					log.Printf("Error copying response body [%s]: %v", describeRequest(r, requestID), err)
+					recorder.capture.discard()
+					panic(http.ErrAbortHandler)
+				}
+			}
+			// Trailers such as gRPC's Grpc-Status are only known once the body is read; TrailerPrefix sends them
+			// without announcing them before the body, which the Trailer header stripped above would have done.
+			for name, values := range resp.Trailer {
+				for _, value := range values {
+					w.Header().Add(http.TrailerPrefix+name, value)
+				}
+			}
+
+			// Upstream time covers everything until response headers arrived; the remainder is body streaming to the client.
+			// A large gap between the two points at a slow client or a large body rather than a slow backend.
+			if cfg.logLatency {
+				log.Printf("%s %s %d upstream=%s total=%s", r.Method, r.URL.Path, resp.StatusCode,
+					upstreamLatency.Round(time.Microsecond), time.Since(start).Round(time.Microsecond))
+			}
+			return
+		}
+	}
+}
+
+// backendEvent is one backend state change, logged as JSON and sent to --event-webhook-url.
+type backendEvent struct {
+	Type     string    `json:"type"`
+	Backend  string    `json:"backend"`
+	OldState string    `json:"old_state"`
+	NewState string    `json:"new_state"`
+	Time     time.Time `json:"time"`
+	Reason   string    `json:"reason,omitempty"`
+}
+
+// backendHealth derives backend state from live traffic, without probes: threshold consecutive transport failures
+// (refused or reset connections, timeouts) mark a backend unhealthy, and its next answered request marks it healthy
+// again. Only transitions produce events, so a backend that stays down is reported once.
+// Routing is not affected; the state only feeds alerting. A nil *backendHealth tracks nothing.
+type backendHealth struct {
+	threshold int
+	webhook   *eventWebhook
+
+	mu        sync.Mutex
+	failures  map[string]int
+	unhealthy map[string]bool
+}
+
+// newBackendHealth tracks backends with the given failure threshold; webhook may be nil.
+func newBackendHealth(threshold int, webhook *eventWebhook) *backendHealth {
+	return &backendHealth{threshold: threshold, webhook: webhook, failures: make(map[string]int), unhealthy: make(map[string]bool)}
+}
+
+// failure counts one failed exchange with backend.
+func (h *backendHealth) failure(backend string, err error) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	h.failures[backend]++
+	changed := h.failures[backend] >= h.threshold && !h.unhealthy[backend]
+	if changed {
+		h.unhealthy[backend] = true
+	}
+	count := h.failures[backend]
+	h.mu.Unlock()
+	if changed {
+		h.emit(backendEvent{Backend: backend, OldState: "healthy", NewState: "unhealthy",
+			Reason: fmt.Sprintf("%d consecutive failures, last: %v", count, err)})
+	}
+}
+
+// success resets the failure count of backend and reports its recovery if it was unhealthy.
+func (h *backendHealth) success(backend string) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	changed := h.unhealthy[backend]
+	delete(h.failures, backend)
+	delete(h.unhealthy, backend)
+	h.mu.Unlock()
+	if changed {
+		h.emit(backendEvent{Backend: backend, OldState: "unhealthy", NewState: "healthy", Reason: "request succeeded"})
+	}
+}
+
+// emit logs the event as one JSON line, with a WARNING prefix for outages so syslog gives them warning severity.
+func (h *backendHealth) emit(event backendEvent) {
+	event.Type, event.Time = "backend_state", time.Now()
+	encoded, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Error encoding backend event: %v", err)
+		return
+	}
+	if event.NewState == "unhealthy" {
+		log.Printf("WARNING: backend state changed: %s", encoded)
+	} else {
+		log.Printf("Backend state changed: %s", encoded)
+	}
+	if h.webhook != nil {
+		h.webhook.send(encoded)
+	}
+}
+
+// eventWebhookQueue bounds the events waiting for delivery while the webhook receiver is down.
+const eventWebhookQueue = 100
+
+// eventWebhookAttempts is how often one event is posted before it is given up; delays between attempts grow from
+// one second to half a minute.
+const eventWebhookAttempts = 6
+
+// eventWebhook posts events to --event-webhook-url from a single goroutine, so they arrive in the order they happened
+// and a slow receiver never holds up proxied requests.
+type eventWebhook struct {
+	url    string
+	client *http.Client
+	queue  chan []byte
+}
+
+// newEventWebhook starts the delivery goroutine.
+func newEventWebhook(url string) *eventWebhook {
+	webhook := &eventWebhook{url: url, client: &http.Client{Timeout: 10 * time.Second}, queue: make(chan []byte, eventWebhookQueue)}
+	go webhook.deliverAll()
+	return webhook
+}
+
+// send queues an event, dropping it if the queue is full rather than blocking the caller.
+func (wh *eventWebhook) send(event []byte) {
+	select {
+	case wh.queue <- event:
+	default:
+		log.Printf("WARNING: event webhook queue full, dropping event: %s", event)
+	}
+}
+
+// deliverAll posts queued events one after another.
+func (wh *eventWebhook) deliverAll() {
+	for event := range wh.queue {
+		wh.deliver(event)
+	}
+}
+
+// deliver posts one event, retrying failed attempts and non-2xx answers with backoff.
+// The URL is kept out of the log because webhook URLs often embed a token.
+func (wh *eventWebhook) deliver(event []byte) {
+	for attempt := 0; attempt < eventWebhookAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(retryDelay(attempt-1, time.Second, 30*time.Second, "equal"))
+		}
+		resp, err := wh.client.Post(wh.url, "application/json", bytes.NewReader(event))
+		if err == nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+			if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+				return
+			}
+			err = fmt.Errorf("webhook answered %s", resp.Status)
+		}
+		log.Printf("Error delivering event to webhook (attempt %d of %d): %v", attempt+1, eventWebhookAttempts, err)
+	}
+	log.Printf("Error delivering event to webhook, giving up: %s", event)
+}
+
+// accessLogger writes bare access log lines to stdout, without the timestamp prefix of the diagnostic log.
+var accessLogger = log.New(os.Stdout, "", 0)
+
+// syslogFacilities maps --syslog-facility names to their RFC 5424 facility codes.
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// Syslog severities used by the proxy; the diagnostic log picks one from the message prefix.
+const (
+	syslogErr     = 3
+	syslogWarning = 4
+	syslogInfo    = 6
+)
+
+// syslogWriter ships log lines to a local or remote syslog daemon. It is written against plain net.Conn rather
+// than log/syslog because that package does not build on Windows, and it redials after a failed write so a
+// restarted rsyslog or syslog-ng picks the stream up again instead of the proxy going silent until its own restart.
+// Lines are handed to a single delivery goroutine through a bounded queue: a daemon that stops reading then costs
+// dropped lines, never a blocked log.Printf in every request handler.
+type syslogWriter struct {
+	network  string
+	address  string
+	facility int
+	tag      string
+	hostname string
+	queue    chan string
+	// pending counts queued lines not yet written or dropped, for flush.
+	pending atomic.Int64
+	// dropping remembers that the loss of messages was already reported, to report it once per outage.
+	dropping atomic.Bool
+
+	// conn and retryAt belong to the delivery goroutine; retryAt throttles redials while the endpoint is down.
+	conn    net.Conn
+	retryAt time.Time
+}
+
+// syslogQueueSize bounds the lines waiting for a slow or unreachable daemon; syslogWriteTimeout bounds one write,
+// so a peer that stopped reading is abandoned and redialled.
+const (
+	syslogQueueSize    = 4096
+	syslogWriteTimeout = 2 * time.Second
+)
+
+// flushLogs waits briefly for queued syslog lines before the process exits; it does nothing without --syslog-addr.
+var flushLogs = func() {}
+
+// newSyslogWriter parses udp://host:port, tcp://host:port, unix:///dev/log or a bare host:port (UDP, port 514
+// by default). The first connection is attempted here; if it fails the writer keeps retrying on later lines.
+func newSyslogWriter(addr, facility, tag string) (*syslogWriter, error) {
+	code, ok := syslogFacilities[strings.ToLower(facility)]
+	if !ok {
+		return nil, fmt.Errorf("unknown facility %q", facility)
+	}
+	if tag == "" || strings.ContainsAny(tag, " :[]") {
+		return nil, fmt.Errorf("tag %q must be non-empty without spaces, colons or brackets", tag)
+	}
+	network, address := "udp", addr
+	if scheme, rest, found := strings.Cut(addr, "://"); found {
+		network, address = strings.ToLower(scheme), rest
+	}
+	switch network {
+	case "udp", "tcp":
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			address = net.JoinHostPort(address, "514")
+		}
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return nil, err
+		}
+	case "unix":
+		if address == "" {
+			return nil, fmt.Errorf("missing socket path in %q", addr)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q, use udp, tcp or unix", network)
+	}
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "-"
+	}
+	w := &syslogWriter{network: network, address: address, facility: code, tag: tag, hostname: hostname, queue: make(chan string, syslogQueueSize)}
+	if err := w.connect(); err != nil {
+		fmt.Fprintf(os.Stderr, "WARNING: syslog endpoint %s is unreachable, will keep retrying: %v\n", addr, err)
+	}
+	go w.deliver()
+	return w, nil
+}
+
+// connect dials the endpoint. Local sockets are usually datagram sockets (/dev/log), but some daemons listen on
+// stream sockets, so both are tried in the same order as the standard library.
+func (w *syslogWriter) connect() error {
+	var conn net.Conn
+	var err error
+	if w.network == "unix" {
+		for _, network := range []string{"unixgram", "unix"} {
+			if conn, err = net.DialTimeout(network, w.address, 2*time.Second); err == nil {
+				break
+			}
+		}
+	} else {
+		conn, err = net.DialTimeout(w.network, w.address, 2*time.Second)
+	}
+	if err != nil {
+		return err
+	}
+	w.conn = conn
+	return nil
+}
+
+// format renders one message in the RFC 3164 layout rsyslog and syslog-ng both accept. The local socket
+// form omits the hostname, which the daemon fills in itself.
+func (w *syslogWriter) format(severity int, message string) string {
+	priority := w.facility*8 + severity
+	message = strings.TrimRight(message, "\n")
+	if w.network == "unix" {
+		return fmt.Sprintf("<%d>%s %s[%d]: %s\n", priority, time.Now().Format(time.Stamp), w.tag, os.Getpid(), message)
+	}
+	return fmt.Sprintf("<%d>%s %s %s[%d]: %s\n", priority, time.Now().Format(time.RFC3339), w.hostname, w.tag, os.Getpid(), message)
+}
+
+// send queues one message without waiting; when the queue is full the message is dropped, since blocking request
+// handling on a logging outage would turn it into a proxy outage.
+func (w *syslogWriter) send(severity int, message string) {
+	w.pending.Add(1)
+	select {
+	case w.queue <- w.format(severity, message):
+	default:
+		w.pending.Add(-1)
+		w.reportDrop(errors.New("delivery queue full"))
+	}
+}
+
+// deliver writes queued messages in order.
+func (w *syslogWriter) deliver() {
+	for line := range w.queue {
+		w.write(line)
+		w.pending.Add(-1)
+	}
+}
+
+// write sends one line, redialling once if the connection has gone away or stalled past syslogWriteTimeout.
+// Lines that still cannot be delivered are dropped.
+func (w *syslogWriter) write(line string) {
+	for attempt := 0; attempt < 2; attempt++ {
+		if w.conn == nil {
+			if time.Now().Before(w.retryAt) {
+				break
+			}
+			if err := w.connect(); err != nil {
+				w.retryAt = time.Now().Add(time.Second)
+				w.reportDrop(err)
+				return
+			}
+		}
+		w.conn.SetWriteDeadline(time.Now().Add(syslogWriteTimeout))
+		if _, err := io.WriteString(w.conn, line); err != nil {
+			w.conn.Close()
+			w.conn = nil
+			if attempt == 1 {
+				w.reportDrop(err)
+			}
+			continue
+		}
+		if w.dropping.CompareAndSwap(true, false) {
+			fmt.Fprintf(os.Stderr, "syslog endpoint %s://%s is reachable again\n", w.network, w.address)
+		}
+		return
+	}
+	w.reportDrop(errors.New("endpoint unavailable"))
+}
+
+// flush waits until every queued line is written or dropped, or timeout passes.
+func (w *syslogWriter) flush(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for w.pending.Load() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// reportDrop notes lost messages on stderr once per outage; it cannot use the log package, which may be the caller.
+func (w *syslogWriter) reportDrop(err error) {
+	if !w.dropping.CompareAndSwap(false, true) {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "WARNING: dropping syslog messages for %s://%s: %v\n", w.network, w.address, err)
+}
+
+// syslogStream adapts syslogWriter to the io.Writer a log.Logger expects; every Write is one log entry.
+type syslogStream struct {
+	w *syslogWriter
+	// diagnostic marks the standard logger: its timestamp prefix is stripped, since syslog adds its own,
+	// and the severity follows the "Error", "Invalid" and "WARNING" prefixes the proxy uses for its messages.
+	diagnostic bool
+}
+
+// logTimestampLen is the length of the "2006/01/02 15:04:05 " prefix written by log.LstdFlags.
+const logTimestampLen = len("2006/01/02 15:04:05 ")
+
+func (s syslogStream) Write(p []byte) (int, error) {
+	message := string(p)
+	severity := syslogInfo
+	if s.diagnostic {
+		if len(message) > logTimestampLen {
+			message = message[logTimestampLen:]
+		}
+		switch {
+		case strings.HasPrefix(message, "Error"), strings.HasPrefix(message, "Invalid"):
+			severity = syslogErr
+		case strings.HasPrefix(message, "WARNING"):
+			severity = syslogWarning
+		}
+	}
+	s.w.send(severity, message)
+	return len(p), nil
+}
+
+// accessLogFormats are presets accepted by --access-log-format in place of a template.
+var accessLogFormats = map[string]string{
+	"combined": `$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent "$http_referer" "$http_user_agent"`,
+	"common":   `$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent`,
+}
+
+// accessLogEscaper keeps client-controlled values from breaking the quoting of a log line, the way nginx escapes them.
+var accessLogEscaper = strings.NewReplacer(`"`, `\x22`, `\`, `\x5C`, "\n", `\x0A`, "\r", `\x0D`)
+
+// accessLogValue resolves one nginx-style variable; ok is false for names the proxy does not know.
+// $http_NAME reads any request header, with underscores standing for dashes as in nginx.
+func accessLogValue(name string, r *http.Request, rec *statusRecorder, start time.Time) (string, bool) {
+	orDash := func(value string) string {
+		if value == "" {
+			return "-"
+		}
+		return accessLogEscaper.Replace(value)
+	}
+	switch name {
+	case "remote_addr":
+		if ip := remoteIP(r); ip != nil {
+			return ip.String(), true
+		}
+		return r.RemoteAddr, true
+	case "remote_user":
+		user, _, _ := r.BasicAuth()
+		return orDash(user), true
+	case "time_local":
+		return start.Format("02/Jan/2006:15:04:05 -0700"), true
+	case "time_iso8601":
+		return start.Format(time.RFC3339), true
+	case "request":
+		return accessLogEscaper.Replace(r.Method + " " + r.RequestURI + " " + r.Proto), true
+	case "request_method":
+		return accessLogEscaper.Replace(r.Method), true
+	case "request_uri":
+		return accessLogEscaper.Replace(r.RequestURI), true
+	case "server_protocol":
+		return r.Proto, true
+	case "host":
+		return orDash(r.Host), true
+	case "status":
+		// nginx logs 499 when the client went away before a response; the recorder leaves 0 in that case.
+		if rec.status == 0 {
+			return "499", true
+		}
+		return strconv.Itoa(rec.status), true
+	case "body_bytes_sent":
+		return strconv.FormatInt(rec.bytes, 10), true
+	case "bytes_received":
+		return strconv.FormatInt(rec.received.Load(), 10), true
+	case "request_time":
+		return fmt.Sprintf("%.3f", time.Since(start).Seconds()), true
+	case "upstream_addr":
+		return orDash(rec.upstream), true
+	case "request_id":
+		return orDash(rec.requestID), true
+	case "variant":
+		return orDash(rec.variant), true
+	}
+	if header, ok := strings.CutPrefix(name, "http_"); ok && header != "" {
+		return orDash(r.Header.Get(strings.ReplaceAll(header, "_", "-"))), true
+	}
+	return "", false
+}
+
+// formatAccessLog renders the --access-log-format template for one finished request.
+func formatAccessLog(format string, r *http.Request, rec *statusRecorder, start time.Time) string {
+	return os.Expand(format, func(name string) string {
+		value, _ := accessLogValue(name, r, rec, start)
+		return value
+	})
+}
+
+// validateAccessLogFormat rejects unknown variables at startup instead of logging empty fields for every request.
+func validateAccessLogFormat(format string) error {
+	var unknown []string
+	probe := &http.Request{Method: http.MethodGet, URL: &url.URL{Path: "/"}, Header: http.Header{}}
+	os.Expand(format, func(name string) string {
+		if _, ok := accessLogValue(name, probe, &statusRecorder{}, time.Now()); !ok {
+			unknown = append(unknown, "$"+name)
+		}
+		return ""
+	})
+	if len(unknown) > 0 {
+		return fmt.Errorf("unknown variables %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// accessRecord is one line of --access-log-file. Values are raw, since JSON encoding already keeps them from breaking the line.
+type accessRecord struct {
+	Time          time.Time `json:"time"`
+	RequestID     string    `json:"request_id"`
+	RemoteAddr    string    `json:"remote_addr"`
+	RemoteUser    string    `json:"remote_user,omitempty"`
+	Method        string    `json:"method"`
+	URI           string    `json:"uri"`
+	Protocol      string    `json:"protocol"`
+	Host          string    `json:"host"`
+	Status        int       `json:"status"`
+	BodyBytesSent int64     `json:"body_bytes_sent"`
+	BytesReceived int64     `json:"bytes_received"`
+	RequestTime   float64   `json:"request_time"`
+	UpstreamAddr  string    `json:"upstream_addr,omitempty"`
+	Variant       string    `json:"variant,omitempty"`
+	Referer       string    `json:"referer,omitempty"`
+	UserAgent     string    `json:"user_agent,omitempty"`
+}
+
+// writeAccessRecord logs a finished request as JSON, with the same status and client conventions as the text access log.
+func writeAccessRecord(logger *log.Logger, r *http.Request, rec *statusRecorder, start time.Time) {
+	record := accessRecord{
+		Time:          start,
+		RequestID:     rec.requestID,
+		RemoteAddr:    r.RemoteAddr,
+		Method:        r.Method,
+		URI:           r.RequestURI,
+		Protocol:      r.Proto,
+		Host:          r.Host,
+		Status:        rec.status,
+		BodyBytesSent: rec.bytes,
+		BytesReceived: rec.received.Load(),
+		RequestTime:   time.Since(start).Seconds(),
+		UpstreamAddr:  rec.upstream,
+		Variant:       rec.variant,
+		Referer:       r.Referer(),
+		UserAgent:     r.UserAgent(),
+	}
+	if ip := remoteIP(r); ip != nil {
+		record.RemoteAddr = ip.String()
+	}
+	record.RemoteUser, _, _ = r.BasicAuth()
+	// As in the text log, a client that left before any response is recorded as nginx's 499.
+	if record.Status == 0 {
+		record.Status = 499
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Error encoding access record: %v", err)
+		return
+	}
+	logger.Print(string(line))
+}
+
+// reopenAccessLogOnSignal reopens the JSON access log file on every SIGHUP, so logrotate can move it away
+// without copytruncate. SetOutput waits for a record being written, after which the old file can be closed.
+func reopenAccessLogOnSignal(logger *log.Logger, path string, current *os.File) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			log.Printf("Error reopening access log file %s on SIGHUP, keeping the previous one: %v", path, err)
+			continue
+		}
+		logger.SetOutput(file)
+		current.Close()
+		current = file
+		log.Printf("Access log file %s reopened on SIGHUP", path)
+	}
+}
+
+// overridableMethods are the only verbs a POST may turn into; anything else could smuggle requests past method-based rules.
+var overridableMethods = map[string]bool{http.MethodPut: true, http.MethodPatch: true, http.MethodDelete: true}
+
+// methodOverride returns the method a POST asks for via header (preferred) or _method, and the query without _method.
+// Without either, the request stays a POST.
+func methodOverride(r *http.Request, header string) (string, string, error) {
+	requested := r.Header.Get(header)
+	var kept []string
+	if r.URL.RawQuery != "" {
+		// Filtering the raw pairs keeps the remaining parameters byte-identical and in their original order.
+		for _, pair := range strings.Split(r.URL.RawQuery, "&") {
+			if name, value, _ := strings.Cut(pair, "="); name == "_method" {
+				if requested == "" {
+					requested, _ = url.QueryUnescape(value)
+				}
+				continue
+			}
+			kept = append(kept, pair)
+		}
+	}
+	if requested == "" {
+		return r.Method, r.URL.RawQuery, nil
+	}
+	requested = strings.ToUpper(strings.TrimSpace(requested))
+	if !overridableMethods[requested] {
+		return "", "", fmt.Errorf("method %q is not one of PUT, PATCH or DELETE", requested)
+	}
+	return requested, strings.Join(kept, "&"), nil
+}
+
+// matchesAuditPath reports whether the cleaned request path equals an audit prefix or lies below it.
+// Whole segments only, as with --strip-path-prefix, and cleaning stops /api/./transactions from slipping past.
+func matchesAuditPath(requestPath string, prefixes []string) bool {
+	cleaned := path.Clean("/" + requestPath)
+	for _, prefix := range prefixes {
+		if cleaned == prefix || strings.HasPrefix(cleaned, strings.TrimSuffix(prefix, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// cappedBuffer keeps the first limit bytes written to it and silently drops the rest, so a tee never fails the upload.
+// It is locked because with --forward-headers-only the transport may still be sending the body when the handler returns.
+type cappedBuffer struct {
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+// Write stores what fits under the cap and always reports success.
+func (c *cappedBuffer) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if room := c.limit - c.buf.Len(); room < len(p) {
+		c.truncated = true
+		if room > 0 {
+			c.buf.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	c.buf.Write(p)
+	return len(p), nil
+}
+
+// contents returns a copy of what was captured so far and whether anything was dropped.
+func (c *cappedBuffer) contents() ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return bytes.Clone(c.buf.Bytes()), c.truncated
+}
+
+// auditRecord is one line of the audit log.
+type auditRecord struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	Client    string    `json:"client"`
+	Method    string    `json:"method"`
+	URI       string    `json:"uri"`
+	Body      string    `json:"body"`
+	Truncated bool      `json:"truncated,omitempty"`
+}
+
+// writeAuditRecord logs the captured body once the handler is done with it.
+// JSON bodies have auditRedact fields masked; a JSON body that cannot be parsed (or was cut at the cap) is withheld
+// rather than written with its secrets intact.
+func writeAuditRecord(cfg proxyConfig, r *http.Request, requestID string, captured *cappedBuffer) {
+	body, truncated := captured.contents()
+	record := auditRecord{
+		Time:      time.Now(),
+		RequestID: requestID,
+		Client:    r.RemoteAddr,
+		Method:    r.Method,
+		URI:       r.RequestURI,
+		Body:      string(body),
+		Truncated: truncated,
+	}
+	if ip := remoteIP(r); ip != nil {
+		record.Client = ip.String()
+	}
+	if len(cfg.auditRedact) > 0 && isJSONContent(r.Header.Get("Content-Type")) {
+		record.Body = "[withheld: JSON body could not be redacted]"
+		var document any
+		if !truncated && json.Unmarshal(body, &document) == nil {
+			if redacted, err := json.Marshal(redactJSON(document, cfg.auditRedact)); err == nil {
+				record.Body = string(redacted)
+			}
+		}
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Error encoding audit record [%s]: %v", describeRequest(r, requestID), err)
+		return
+	}
+	cfg.auditLog.Print(string(line))
+}
+
+// isJSONContent matches application/json and the +json structured syntax suffix.
+func isJSONContent(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"))
+}
+
+// redactJSON masks the values of the named fields at any depth; names compare case-insensitively (lower-cased keys).
+func redactJSON(value any, fields map[string]bool) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, child := range v {
+			if fields[strings.ToLower(key)] {
+				v[key] = "***"
+			} else {
+				v[key] = redactJSON(child, fields)
+			}
+		}
+	case []any:
+		for i, child := range v {
+			v[i] = redactJSON(child, fields)
+		}
+	}
+	return value
+}
+
+// requestIDPrefix makes IDs unique across restarts and instances; the counter makes them unique within this process.
+var requestIDPrefix = func() string {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano()&0xffffffff, 16)
+	}
+	return hex.EncodeToString(b[:])
+}()
+
+// requestIDCounter numbers the requests of this process.
+var requestIDCounter atomic.Uint64
+
+// newRequestID returns a short unique ID: a counter needs no entropy per request, keeping the hot path cheap.
+func newRequestID() string {
+	return requestIDPrefix + "-" + strconv.FormatUint(requestIDCounter.Add(1), 16)
+}
+
+// incomingRequestID reuses an ID set by an edge proxy in front of us, so one ID follows the request end to end.
+// Oversized values or ones with spaces or control characters are ignored because they end up in log lines.
+func incomingRequestID(r *http.Request, header string) string {
+	if header == "" {
+		return ""
+	}
+	id := r.Header.Get(header)
+	if len(id) > 128 {
+		return ""
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] >= 0x7f {
+			return ""
+		}
+	}
+	return id
+}
+
+// describeRequest renders the request for error lines; it only runs once something failed, so it costs nothing otherwise.
+func describeRequest(r *http.Request, requestID string) string {
+	client := r.RemoteAddr
+	if ip := remoteIP(r); ip != nil {
+		client = ip.String()
+	}
+	return fmt.Sprintf("id=%s client=%s %s %s", requestID, client, r.Method, r.URL.Path)
+}
+
+// phaseTimings sums the connection phases of every upstream hop for --server-timing.
+// Trace hooks run on transport goroutines, and a dial may finish after the request was served from another connection.
+type phaseTimings struct {
+	mu                            sync.Mutex
+	dnsStart, connStart, tlsStart time.Time
+	dns, connect, tls             time.Duration
+}
+
+// trace records DNS, TCP connect and TLS handshake durations.
+func (t *phaseTimings) trace() *httptrace.ClientTrace {
+	since := func(start *time.Time, total *time.Duration) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if !start.IsZero() {
+			*total += time.Since(*start)
+		}
+	}
+	mark := func(start *time.Time) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		*start = time.Now()
+	}
+	return &httptrace.ClientTrace{
+		DNSStart:          func(httptrace.DNSStartInfo) { mark(&t.dnsStart) },
+		DNSDone:           func(httptrace.DNSDoneInfo) { since(&t.dnsStart, &t.dns) },
+		ConnectStart:      func(string, string) { mark(&t.connStart) },
+		ConnectDone:       func(string, string, error) { since(&t.connStart, &t.connect) },
+		TLSHandshakeStart: func() { mark(&t.tlsStart) },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { since(&t.tlsStart, &t.tls) },
+	}
+}
+
+// header renders the Server-Timing value; upstream covers everything from the first hop until response headers arrived.
+func (t *phaseTimings) header(proxy, upstream time.Duration) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ms := func(d time.Duration) string {
+		return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 1, 64)
+	}
+	return fmt.Sprintf("proxy;dur=%s, dns;dur=%s, connect;dur=%s, tls;dur=%s, upstream;dur=%s",
+		ms(proxy), ms(t.dns), ms(t.connect), ms(t.tls), ms(upstream))
+}
+
+// hostAllowed matches the request host, without port and trailing dot, against exact names and *.example.com wildcards.
+// A wildcard covers subdomains only, so list the apex separately when it is served too.
+func hostAllowed(host string, allowed []string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, pattern := range allowed {
+		if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+			if strings.HasSuffix(host, suffix) && len(host) > len(suffix) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// canaryClientID picks the stable identifier for canary stickiness: the named cookie when the client has it, else its IP.
+// Cookies survive IP changes on mobile networks; the IP keeps first-time visitors and cookieless clients sticky too.
+func canaryClientID(r *http.Request, cookieName string) string {
+	if cookieName != "" {
+		if cookie, err := r.Cookie(cookieName); err == nil && cookie.Value != "" {
+			return cookie.Value
+		}
+	}
+	if ip := remoteIP(r); ip != nil {
+		return ip.String()
+	}
+	return r.RemoteAddr
+}
+
+// canaryBucket maps a client identifier to a stable bucket in [0, 100).
+func canaryBucket(id string) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(id))
+	return int(hash.Sum32() % 100)
+}
+
+// hashRingReplicas is how many points each unit of --hash-backend weight places on the ring.
+// More points spread keys more evenly at the cost of a larger table to search.
+const hashRingReplicas = 160
+
+// hashBackend is one --hash-backend entry; weight scales its share of the keys.
+type hashBackend struct {
+	target string
+	host   string
+	user   *url.Userinfo
+	weight int
+}
+
+// hashRing is a consistent-hash ring: adding or removing a backend only moves the keys that land on its points,
+// while every other key keeps its backend and the cache warmed up there.
+type hashRing struct {
+	backends []hashBackend
+	points   []hashPoint
+}
+
+// hashPoint is one position on the ring, owned by backends[backend].
+type hashPoint struct {
+	hash    uint64
+	backend int
+}
+
+// newHashRing places each backend's points by hashing its URL, so the ring is the same on every proxy
+// instance and across restarts, whatever order the backends are listed in.
+func newHashRing(backends []hashBackend) *hashRing {
+	ring := &hashRing{backends: backends}
+	for i, backend := range backends {
+		for replica := 0; replica < hashRingReplicas*backend.weight; replica++ {
+			ring.points = append(ring.points, hashPoint{hash: hashKey(backend.target + "#" + strconv.Itoa(replica)), backend: i})
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool { return ring.points[i].hash < ring.points[j].hash })
+	return ring
+}
+
+// pick returns the backend owning the first point at or after the key's hash, wrapping around the ring.
+func (ring *hashRing) pick(key string) hashBackend {
+	hash := hashKey(key)
+	i := sort.Search(len(ring.points), func(i int) bool { return ring.points[i].hash >= hash })
+	if i == len(ring.points) {
+		i = 0
+	}
+	return ring.backends[ring.points[i].backend]
+}
+
+// hashKey hashes ring keys and backend points alike. FNV alone leaves keys that differ in one trailing character,
+// such as the numbered points of one backend, close together, so the murmur3 finaliser spreads them over the ring.
+func hashKey(key string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+	h := hash.Sum64()
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+// parseHashBackend parses "URL" or "URL=WEIGHT"; credentials in the URL are split off like those of --target-url.
+func parseHashBackend(value, scheme string) (hashBackend, error) {
+	rawTarget, weight := value, 1
+	if i := strings.LastIndex(value, "="); i >= 0 {
+		parsed, err := strconv.Atoi(value[i+1:])
+		if err != nil || parsed < 1 || parsed > 100 {
+			return hashBackend{}, fmt.Errorf("invalid weight in %q (expected 1-100)", value)
+		}
+		rawTarget, weight = value[:i], parsed
+	}
+	target, err := url.Parse(rawTarget)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return hashBackend{}, fmt.Errorf("invalid backend URL in %q", value)
+	}
+	if scheme != "" {
+		target.Scheme = scheme
+	}
+	user := target.User
+	target.User = nil
+	return hashBackend{target: strings.TrimSuffix(target.String(), "/"), host: target.Host, user: user, weight: weight}, nil
+}
+
+// parseBackendOverride validates an X-Proxy-Backend value: an absolute http(s) URL whose path, if any, acts as the base path.
+func parseBackendOverride(value string) (*url.URL, error) {
+	backend, err := url.Parse(strings.TrimSpace(value))
+	if err != nil {
+		return nil, err
+	}
+	if backend.Scheme != "http" && backend.Scheme != "https" {
+		return nil, fmt.Errorf("scheme must be http or https, got %q", backend.Scheme)
+	}
+	if backend.Host == "" {
+		return nil, fmt.Errorf("missing host in %q", value)
+	}
+	if backend.User != nil || backend.RawQuery != "" || backend.Fragment != "" {
+		return nil, fmt.Errorf("only scheme, host and path are allowed in %q", value)
+	}
+	return backend, nil
+}
+
+// formatHeaders renders headers on one line in a stable order, replacing the values of redacted headers with ***.
+func formatHeaders(header http.Header, redacted map[string]bool) string {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var out strings.Builder
+	for _, name := range names {
+		for _, value := range header[name] {
+			if out.Len() > 0 {
+				out.WriteString("; ")
+			}
+			if redacted[http.CanonicalHeaderKey(name)] {
+				value = "***"
+			}
+			fmt.Fprintf(&out, "%s: %s", name, value)
+		}
+	}
+	return out.String()
+}
+
+// setClientCertHeaders replaces any client-sent X-Client-Cert* headers with the leaf certificate of a verified chain.
+// Unverified certificates are never forwarded: without --client-ca the handshake does not ask for one at all.
+func setClientCertHeaders(header http.Header, state *tls.ConnectionState, includePEM bool) {
+	for _, name := range clientCertHeaders {
+		header.Del(name)
+	}
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return
+	}
+	cert := state.PeerCertificates[0]
+	header.Set("X-Client-Cert-Subject", cert.Subject.String())
+	header.Set("X-Client-Cert-Issuer", cert.Issuer.String())
+	header.Set("X-Client-Cert-Serial", cert.SerialNumber.Text(16))
+	if includePEM {
+		// PEM spans several lines, which a header value cannot; URL encoding matches what nginx sends as $ssl_client_escaped_cert.
+		block := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+		header.Set("X-Client-Cert", strings.ReplaceAll(url.QueryEscape(string(block)), "+", "%20"))
+	}
+}
+
+// copyHeader appends every value of every header in src to dst.
+// Values are never joined: Set-Cookie must stay one header line per cookie because cookie dates contain commas,
+// and WWW-Authenticate challenges or Vary lists are passed on exactly as the upstream framed them.
+func copyHeader(dst, src http.Header) {
+	for header, values := range src {
+		for _, value := range values {
+			dst.Add(header, value)
+		}
+	}
+}
+
+// hopByHopHeaders apply to a single connection and must not be forwarded by proxies (RFC 9110 section 7.6.1).
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// securityHeader is one entry of --security-headers or --security-header; an empty value removes the header.
+type securityHeader struct {
+	name     string
+	value    string
+	override bool
+	// httpsOnly headers are pointless or harmful on plain HTTP, such as HSTS, which browsers ignore there.
+	httpsOnly bool
+}
+
+// securityHeaderPresets are the bundles --security-headers can apply. "basic" is meant to be safe in front of an
+// arbitrary site, so its CSP only restricts framing, plugins and <base>; "strict" also limits content to the site's
+// own origin and breaks pages that load scripts or styles from CDNs. Expect-CT is left out: browsers no longer act on it.
+var securityHeaderPresets = map[string][]securityHeader{
+	"basic": {
+		{name: "Strict-Transport-Security", value: "max-age=31536000", httpsOnly: true},
+		{name: "X-Content-Type-Options", value: "nosniff"},
+		{name: "X-Frame-Options", value: "SAMEORIGIN"},
+		{name: "Referrer-Policy", value: "strict-origin-when-cross-origin"},
+		{name: "Content-Security-Policy", value: "frame-ancestors 'self'; object-src 'none'; base-uri 'self'"},
+	},
+	"strict": {
+		{name: "Strict-Transport-Security", value: "max-age=63072000; includeSubDomains", httpsOnly: true},
+		{name: "X-Content-Type-Options", value: "nosniff"},
+		{name: "X-Frame-Options", value: "DENY"},
+		{name: "Referrer-Policy", value: "no-referrer"},
+		{name: "Content-Security-Policy", value: "default-src 'self'; frame-ancestors 'none'; object-src 'none'; base-uri 'self'"},
+		{name: "Cross-Origin-Opener-Policy", value: "same-origin"},
+	},
+}
+
+// buildSecurityHeaders combines a preset with NAME=VALUE overrides; an override replaces the preset entry of the same name.
+func buildSecurityHeaders(preset string, overrides []string) ([]securityHeader, error) {
+	var headers []securityHeader
+	if preset != "" {
+		entries, ok := securityHeaderPresets[preset]
+		if !ok {
+			return nil, fmt.Errorf("unknown preset %q, use basic or strict", preset)
+		}
+		headers = append(headers, entries...)
+	}
+	for _, value := range overrides {
+		name, headerValue, ok := strings.Cut(value, "=")
+		name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+		if !ok || name == "" {
+			return nil, fmt.Errorf("expected NAME=VALUE, got %q", value)
+		}
+		entry := securityHeader{name: name, value: strings.TrimSpace(headerValue), override: true, httpsOnly: name == "Strict-Transport-Security"}
+		replaced := false
+		for i := range headers {
+			if headers[i].name == name {
+				headers[i], replaced = entry, true
+			}
+		}
+		if !replaced {
+			headers = append(headers, entry)
+		}
+	}
+	return headers, nil
+}
+
+// applySecurityHeaders sets the configured headers on a client response. Preset values do not replace a policy the
+// backend chose for itself, such as its own Content-Security-Policy; explicit overrides do.
+func applySecurityHeaders(header http.Header, headers []securityHeader, https bool) {
+	for _, entry := range headers {
+		switch {
+		case entry.httpsOnly && !https:
+		case entry.value == "":
+			header.Del(entry.name)
+		case entry.override || header.Get(entry.name) == "":
+			header.Set(entry.name, entry.value)
+		}
+	}
+}
+
+// filterResponseHeaders drops upstream headers the operator does not want clients to see, such as X-Powered-By.
+// Names are canonical, which makes matching case-insensitive however the upstream spelled them.
+func filterResponseHeaders(header http.Header, strip, allow map[string]bool) {
+	for name := range header {
+		if strip[name] || (len(allow) > 0 && !allow[name]) {
+			delete(header, name)
+		}
+	}
+}
+
+// removeHopByHopHeaders deletes the standard hop-by-hop headers plus any header the sender listed in Connection.
+// "TE: trailers" survives because gRPC backends require it to know the client understands trailers.
+func removeHopByHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+
+	keepTrailers := false
+	for _, value := range header.Values("Te") {
+		for _, coding := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(coding), "trailers") {
+				keepTrailers = true
+			}
+		}
+	}
+
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+	if keepTrailers {
+		header.Set("Te", "trailers")
+	}
+}
+
+// decompressResponse replaces a gzip-encoded body with its decoded stream and drops the headers describing the encoded bytes.
+// It costs CPU on every such response (inflating runs at a few hundred MB/s per core) and gives up the bandwidth saving
+// towards the client, which is why it only runs while a body-inspecting feature is enabled. Other encodings such as br
+// are left untouched, so features must check Content-Encoding before reading the body.
+func decompressResponse(resp *http.Response) error {
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if encoding != "gzip" && encoding != "x-gzip" {
+		return nil
+	}
+
+	reader, err := gzip.NewReader(resp.Body)
+	if err == io.EOF {
+		// An empty body labelled gzip (typical of 204 and 304) has nothing to decode.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{reader, resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	// Validators and ranges refer to the encoded representation and would be wrong for the decoded bytes.
+	resp.Header.Del("Accept-Ranges")
+	if etag := resp.Header.Get("Etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("Etag", "W/"+etag)
+	}
+	return nil
+}
+
+// maxInjectBody bounds how much HTML is held in memory to find </body>; larger pages stream through unmodified.
+const maxInjectBody = 8 << 20
+
+// injectHTMLFragment inserts fragment before the last </body> of an HTML response and fixes Content-Length.
+// gzip bodies are decoded first and, with recompress, encoded again for clients accepting gzip; other encodings such
+// as br are left alone. Partial and bodiless responses are never touched: splicing into a 206 range would no longer
+// match its Content-Range.
+func injectHTMLFragment(resp *http.Response, fragment []byte, recompress, clientGzip bool) error {
+	if resp.StatusCode == http.StatusPartialContent || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified || resp.ContentLength == 0 {
+		return nil
+	}
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	wasGzip := encoding == "gzip" || encoding == "x-gzip"
+	if err := decompressResponse(resp); err != nil {
+		return err
+	}
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && !strings.EqualFold(encoding, "identity") {
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxInjectBody+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > maxInjectBody {
+		// Too large to rewrite in memory: put the part already read back in front of the rest.
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return nil
+	}
+	resp.Body.Close()
+
+	if i := lastIndexFold(body, []byte("</body>")); i >= 0 {
+		body = append(body[:i:i], append(fragment, body[i:]...)...)
+		if etag := resp.Header.Get("Etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			resp.Header.Set("Etag", "W/"+etag)
+		}
+	}
+
+	// Whether the answer is gzipped now depends on the client's Accept-Encoding, which caches must know.
+	if wasGzip && recompress {
+		addVary(resp.Header, "Accept-Encoding")
+	}
+	if wasGzip && recompress && clientGzip {
+		var compressed bytes.Buffer
+		writer := gzip.NewWriter(&compressed)
+		if _, err := writer.Write(body); err != nil {
+			return err
+		}
+		if err := writer.Close(); err != nil {
+			return err
+		}
+		body = compressed.Bytes()
+		resp.Header.Set("Content-Encoding", "gzip")
+	}
+
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+// addVary lists name in the Vary header unless it is already there or Vary is "*".
+func addVary(header http.Header, name string) {
+	for _, value := range header.Values("Vary") {
+		for _, field := range strings.Split(value, ",") {
+			field = strings.TrimSpace(field)
+			if field == "*" || strings.EqualFold(field, name) {
+				return
+			}
+		}
+	}
+	header.Add("Vary", name)
+}
+
+// errTransformSkipped reports a transform that left the response untouched instead of failing it.
+var errTransformSkipped = errors.New("transform skipped")
+
+// filterResponseBody streams the body through an external command, which reads it on stdin and writes the replacement
+// to stdout, one process per response. A command that cannot be started leaves the response untouched when passthrough
+// is set, reported as errTransformSkipped; once it runs, the client receives its output as it is produced, so a later failure can only cut the body short.
+func filterResponseBody(resp *http.Response, r *http.Request, command []string, passthrough bool) error {
+	if resp.StatusCode == http.StatusPartialContent || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
+	if err := decompressResponse(resp); err != nil {
+		return err
+	}
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && !strings.EqualFold(encoding, "identity") {
+		return nil
+	}
+
+	cmd := exec.CommandContext(r.Context(), command[0], command[1:]...)
+	cmd.Stdin = resp.Body
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		if passthrough {
+			return fmt.Errorf("%w: %v", errTransformSkipped, err)
+		}
+		return err
+	}
+
+	resp.Body = &filteredBody{stdout: stdout, upstream: resp.Body, cmd: cmd}
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	resp.Header.Del("Accept-Ranges")
+	if etag := resp.Header.Get("Etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("Etag", "W/"+etag)
+	}
+	return nil
+}
+
+// filteredBody reads a response filter's stdout and reaps the process when the body is finished with.
+// Both Read, at the end of the output, and Close may reap it, so the process is waited for exactly once.
+type filteredBody struct {
+	stdout   io.ReadCloser
+	upstream io.ReadCloser
+	cmd      *exec.Cmd
+	waitOnce sync.Once
+	waitErr  error
+}
+
+// Read reports a failed command as an error instead of io.EOF, so its output is treated like a broken upstream body
+// rather than as a complete response that happens to be short.
+func (b *filteredBody) Read(p []byte) (int, error) {
+	n, err := b.stdout.Read(p)
+	if err == io.EOF {
+		if waitErr := b.wait(); waitErr != nil {
+			return n, fmt.Errorf("response filter failed: %w", waitErr)
+		}
+	}
+	return n, err
+}
+
+// Close stops a command that is still running because the client went away early; after a full read it has exited.
+func (b *filteredBody) Close() error {
+	b.upstream.Close()
+	b.cmd.Process.Kill()
+	b.wait()
+	return nil
+}
+
+func (b *filteredBody) wait() error {
+	b.waitOnce.Do(func() { b.waitErr = b.cmd.Wait() })
+	return b.waitErr
+}
+
+// lastIndexFold finds the last ASCII case-insensitive occurrence of sep so </BODY> matches too.
+func lastIndexFold(s, sep []byte) int {
+	for i := len(s) - len(sep); i >= 0; i-- {
+		if bytes.EqualFold(s[i:i+len(sep)], sep) {
+			return i
+		}
+	}
+	return -1
+}
+
+// responseTransform is a content-type specific step run on upstream responses before their body is streamed.
+// New body-rewriting features register one instead of adding their own Content-Type checks to the handler.
+type responseTransform struct {
+	name string
+	// mediaTypes are exact types such as text/html or wildcards such as text/*; empty matches every response.
+	mediaTypes []string
+	// apply may replace resp.Body and must then keep Content-Length and Content-Encoding consistent with it.
+	apply func(resp *http.Response, r *http.Request) error
+}
+
+// matches reports whether the transform handles mediaType, the lower-cased type without parameters.
+func (t responseTransform) matches(mediaType string) bool {
+	if len(t.mediaTypes) == 0 {
+		return true
+	}
+	for _, candidate := range t.mediaTypes {
+		if candidate == mediaType {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(candidate, "/*"); ok && strings.HasPrefix(mediaType, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// responseMediaType returns the upstream's declared media type, or "" when it is missing or malformed.
+func responseMediaType(resp *http.Response) string {
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return ""
+	}
+	return mediaType
+}
+
+// parseMediaTypes splits a comma-separated --*-types flag into lower-cased media types.
+func parseMediaTypes(list string) ([]string, error) {
+	var types []string
+	for _, item := range strings.Split(list, ",") {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if item == "" {
+			continue
+		}
+		if major, minor, ok := strings.Cut(item, "/"); !ok || major == "" || major == "*" || minor == "" || strings.Contains(minor, "/") {
+			return nil, fmt.Errorf("%s is not a media type like text/html or text/*", item)
+		}
+		types = append(types, item)
+	}
+	return types, nil
+}
+
+// acceptsGzip reports whether the client listed gzip in Accept-Encoding without refusing it via q=0.
+func acceptsGzip(r *http.Request) bool {
+	for _, value := range r.Header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(value, ",") {
+			name, params, _ := strings.Cut(coding, ";")
+			if !strings.EqualFold(strings.TrimSpace(name), "gzip") {
+				continue
+			}
+			q := strings.ReplaceAll(params, " ", "")
+			return q != "q=0" && q != "q=0.0" && q != "q=0.00" && q != "q=0.000"
+		}
+	}
+	return false
+}
+
+// readFragment resolves --inject-html: inline HTML (anything containing "<"), env:NAME, or a file path.
+func readFragment(value string) ([]byte, error) {
+	if strings.Contains(value, "<") {
+		return []byte(value), nil
+	}
+	if name, ok := strings.CutPrefix(value, "env:"); ok {
+		content := os.Getenv(name)
+		if content == "" {
+			return nil, fmt.Errorf("environment variable %s is empty or unset", name)
+		}
+		return []byte(content), nil
+	}
+	return os.ReadFile(value)
+}
+
+// retryableFailure reports whether a transport error may be retried for method.
+// A failed dial never reached the backend, so any method is safe; other failures (reset, EOF mid-response) may have
+// been processed, so only idempotent methods are sent again.
+func retryableFailure(err error, method string) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// retryDelay returns the wait before retry number attempt (0-based): base doubled per attempt, capped at limit, then jittered.
+// "full" picks uniformly from [0, d] and decorrelates many proxies retrying the same recovering backend best;
+// "equal" keeps at least d/2; "none" is plain exponential backoff.
+func retryDelay(attempt int, base, limit time.Duration, jitter string) time.Duration {
+	d := limit
+	if attempt < 32 && base<<attempt > 0 && base<<attempt < limit {
+		d = base << attempt
+	}
+	switch jitter {
+	case "full":
+		return time.Duration(mathrand.Int64N(int64(d) + 1))
+	case "equal":
+		return d/2 + time.Duration(mathrand.Int64N(int64(d/2)+1))
+	}
+	return d
+}
+
+// errDecodedBodyTooLarge stops decompression bombs: a few KB of gzip can expand to gigabytes.
+var errDecodedBodyTooLarge = errors.New("decompressed request body exceeds the size limit")
+
+// decodeRequestBody decodes a gzip or deflate request body, returning nil for identity, unknown or stacked encodings
+// so those are forwarded untouched. deflate is tried as zlib first (RFC 9110) and then as the raw stream some clients send.
+func decodeRequestBody(body []byte, encoding string, limit int64) ([]byte, error) {
+	var reader io.Reader
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		reader = gz
+	case "deflate":
+		if zr, err := zlib.NewReader(bytes.NewReader(body)); err == nil {
+			reader = zr
+		} else {
+			reader = flate.NewReader(bytes.NewReader(body))
+		}
+	default:
+		return nil, nil
+	}
+	decoded, err := io.ReadAll(io.LimitReader(reader, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(decoded)) > limit {
+		return nil, errDecodedBodyTooLarge
+	}
+	return decoded, nil
+}
+
+// upstreamBody turns the buffered client body into a replayable request body.
+// Empty and missing bodies both become http.NoBody: GET and HEAD then go out without framing headers,
+// while POST, PUT and PATCH still carry Content-Length: 0 so strict upstreams never answer 411 Length Required.
+func upstreamBody(body []byte) io.Reader {
+	if len(body) == 0 {
+		return http.NoBody
+	}
+	return bytes.NewReader(body)
+}
+
+// streamedBody hands the client's body to the upstream request as it arrives, for --forward-headers-only.
+func streamedBody(r *http.Request) io.Reader {
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+		return http.NoBody
+	}
+	return r.Body
+}
+
+// readFirstChunk reads until the body yields its first bytes or ends, so failures can be seen before anything is sent.
+// An empty body returns no bytes and no error.
+func readFirstChunk(body io.Reader) ([]byte, error) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			return buf[:n], nil
+		}
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// streamResponse copies the upstream body to the client chunk by chunk instead of buffering it, starting with head,
+// the bytes already read by readFirstChunk.
+// Bodies of unknown length (chunked, event streams) are flushed after every chunk so long-lived streams reach the client immediately.
+func streamResponse(w http.ResponseWriter, resp *http.Response, head []byte) error {
+	flusher, canFlush := w.(http.Flusher)
+	flushEachChunk := canFlush && resp.ContentLength == -1
+
+	if len(head) > 0 {
+		if _, err := w.Write(head); err != nil {
+			return err
+		}
+	}
+	// Flushing before the first read also sends status and headers of a stream that idles until its first event.
+	if flushEachChunk {
+		flusher.Flush()
+	}
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, readErr := resp.Body.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+			if flushEachChunk {
+				flusher.Flush()
+			}
+		}
+		if readErr == io.EOF {
+			return nil
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+}
+
+// adminHandler serves operational endpoints that must never share a port with public proxy traffic.
+// Everything operators need for diagnostics lives here so one bind address defines the security boundary.
+func adminHandler(stats *proxyStats, allowed []*net.IPNet, target string) http.Handler {
+	mux := http.NewServeMux()
+
+	// A human-readable overview of the same counters as /admin/stats for a quick glance without a metrics stack.
+	mux.HandleFunc("GET /admin/{$}", func(w http.ResponseWriter, r *http.Request) {
+		var page bytes.Buffer
+		if err := dashboardTemplate.Execute(&page, newDashboardData(stats.snapshot(), target)); err != nil {
+			log.Printf("Error rendering admin dashboard: %v", err)
+			http.Error(w, "Failed to render dashboard", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(page.Bytes())
+	})
+
+	// /healthz only proves the process is alive and serving; it deliberately does not probe the upstream.
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, "ok")
+	})
+
+	// Register pprof explicitly so profiling is only reachable through the admin listener.
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	// Counters for debugging without Prometheus; resetting is a POST so crawlers and prefetchers cannot trigger it.
+	mux.HandleFunc("GET /admin/stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(stats.snapshot()); err != nil {
+			log.Printf("Error encoding stats: %v", err)
+		}
+	})
+	mux.HandleFunc("POST /admin/stats/reset", func(w http.ResponseWriter, r *http.Request) {
+		stats.reset()
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	if len(allowed) == 0 {
+		return mux
+	}
+
+	// The allowlist guards the whole admin surface, not just individual endpoints, so new endpoints are protected by default.
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ipInNetworks(remoteIP(r), allowed) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// dashboardRow is one labelled counter on the admin dashboard.
+type dashboardRow struct {
+	Label string
+	Count int64
+	// LastSeen is how long ago the backend last answered; empty for rows that are not backends.
+	LastSeen string
+}
+
+// dashboardData is everything the dashboard template renders, with maps pre-sorted so rows do not jump between refreshes.
+type dashboardData struct {
+	Version  string
+	Target   string
+	Uptime   string
+	Since    string
+	Requests int64
+	Errors   int64
+	Received int64
+	Sent     int64
+	Statuses []dashboardRow
+	Backends []dashboardRow
+	TLS      []dashboardRow
+	Recent   []errorEvent
+}
+
+// newDashboardData flattens a stats snapshot into sorted rows for the dashboard template.
+func newDashboardData(snap statsSnapshot, target string) dashboardData {
+	rows := func(counts map[string]int64) []dashboardRow {
+		list := make([]dashboardRow, 0, len(counts))
+		for label, count := range counts {
+			list = append(list, dashboardRow{Label: label, Count: count})
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Label < list[j].Label })
+		return list
+	}
+
+	backends := rows(snap.Backends)
+	for i := range backends {
+		if seen, ok := snap.LastSeen[backends[i].Label]; ok {
+			backends[i].LastSeen = time.Since(seen).Round(time.Second).String() + " ago"
+		}
+	}
+
+	return dashboardData{
+		Version:  version,
+		Target:   target,
+		Uptime:   time.Since(processStart).Round(time.Second).String(),
+		Since:    snap.Since.Format(time.RFC3339),
+		Requests: snap.Requests,
+		Errors:   snap.Errors,
+		Received: snap.Received,
+		Sent:     snap.Sent,
+		Statuses: rows(snap.Statuses),
+		Backends: backends,
+		TLS:      rows(snap.TLS),
+		Recent:   snap.Recent,
+	}
+}
+
+// remoteIP returns the address of the directly connected peer, or nil if RemoteAddr is unparsable.
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// ipInNetworks reports whether ip belongs to any of the networks; a nil ip never matches.
+func ipInNetworks(ip net.IP, networks []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCIDRs turns a comma-separated list of CIDRs or bare IPs into networks; bare IPs match only themselves.
+func parseCIDRs(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// errUpstreamConnExpired makes the transport drop a pooled connection that outlived --upstream-max-conn-lifetime.
+var errUpstreamConnExpired = errors.New("upstream connection exceeded its maximum lifetime")
+
+// upstreamDialer opens backend connections for the shared transport.
+type upstreamDialer struct {
+	dialer      net.Dialer
+	maxLifetime time.Duration
+	// slots caps connection attempts in flight, so a restarted backend is not hit by every waiting request at once.
+	slots chan struct{}
+}
+
+// dial waits for a free slot before connecting; pooled connections never get here. The transport detaches dials from
+// request cancellation: a request that times out while queued gives up at once, and its dial still runs when a slot
+// frees, leaving the connection in the pool for the next request.
+func (d *upstreamDialer) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d.slots != nil {
+		select {
+		case d.slots <- struct{}{}:
+			defer func() { <-d.slots }()
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return d.dialer.DialContext(ctx, network, addr)
+}
+
+// DialContext dials the backend and, when a lifetime is configured, tags the connection with its expiry.
+func (d *upstreamDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.dial(ctx, network, addr)
+	if err != nil || d.maxLifetime <= 0 {
+		return conn, err
+	}
+	return &agedConn{Conn: conn, expires: time.Now().Add(d.maxLifetime)}, nil
+}
+
+// routedBackendKey marks upstream requests addressed to the backend the handler routed to, as opposed to redirect
+// hops onto other hosts.
+type routedBackendKey struct{}
+
+// h2cRoundTripper speaks cleartext HTTP/2 to the http:// backend a request was routed to. Only that backend is known
+// to speak h2c, so https:// backends and redirect targets on other hosts, which usually speak HTTP/1.1 alone, get
+// the regular transport.
+type h2cRoundTripper struct {
+	h2c      http.RoundTripper
+	fallback http.RoundTripper
+}
+
+func (t h2cRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if routed, _ := req.Context().Value(routedBackendKey{}).(bool); routed && req.URL.Scheme == "http" {
+		return t.h2c.RoundTrip(req)
+	}
+	return t.fallback.RoundTrip(req)
+}
+
+// newH2CTransport dials backends in plain TCP and starts HTTP/2 with prior knowledge, as gRPC backends expect.
+// Connections are multiplexed rather than retired per request, so --upstream-max-conn-lifetime does not apply.
+func newH2CTransport(dialer *upstreamDialer) *http2.Transport {
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return dialer.dial(ctx, network, addr)
+		},
+		DisableCompression: true,
+	}
+}
+
+// responseCache is a shared cache in front of the backends. It keeps GET responses that carry a validator or a
+// freshness lifetime and answers repeats from memory while they are fresh. A stale entry is revalidated with
+// If-None-Match or If-Modified-Since: a 304 refreshes it and its stored body is served again, so large resources that
+// rarely change cross the backend link once. Stored bodies take at most maxBytes, least recently used out first.
+type responseCache struct {
+	next      http.RoundTripper
+	maxBytes  int
+	maxObject int
+
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List
+	// varies holds the Vary header names last stored for a URL, which select the entry matching a request.
+	varies map[string][]string
+}
+
+// cachedResponse is one stored response. It is not changed once stored; a revalidation stores a new one.
+type cachedResponse struct {
+	key      string
+	url      string
+	status   int
+	header   http.Header
+	body     []byte
+	stored   time.Time
+	age      time.Duration
+	lifetime time.Duration
+}
+
+// newResponseCache caches the responses of next in up to maxBytes of memory, maxObject per response.
+func newResponseCache(next http.RoundTripper, maxBytes, maxObject int) *responseCache {
+	return &responseCache{
+		next:      next,
+		maxBytes:  maxBytes,
+		maxObject: maxObject,
+		entries:   make(map[string]*list.Element),
+		lru:       list.New(),
+		varies:    make(map[string][]string),
+	}
+}
+
+func (c *responseCache) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Conditional and range requests belong to the client's own cache and are answered by the backend.
+	directives := cacheDirectives(req.Header)
+	_, noStore := directives["no-store"]
+	if req.Method != http.MethodGet || noStore || req.Header.Get("Range") != "" || req.Header.Get("If-None-Match") != "" ||
+		req.Header.Get("If-Modified-Since") != "" || req.Header.Get("If-Match") != "" || req.Header.Get("If-Unmodified-Since") != "" {
+		return c.next.RoundTrip(req)
+	}
+	resource := req.Host + " " + req.URL.String()
+	entry := c.lookup(resource, req.Header)
+	// A client asking for no-cache still gets the stored body, but only after the backend has confirmed it.
+	_, noCache := directives["no-cache"]
+	now := time.Now()
+	if entry != nil && !noCache && req.Header.Get("Pragma") != "no-cache" && entry.currentAge(now) < entry.lifetime {
+		return entry.response(req, now), nil
+	}
+
+	outgoing := req
+	if entry != nil {
+		outgoing = req.Clone(req.Context())
+		if etag := entry.header.Get("ETag"); etag != "" {
+			outgoing.Header.Set("If-None-Match", etag)
+		}
+		if modified := entry.header.Get("Last-Modified"); modified != "" {
+			outgoing.Header.Set("If-Modified-Since", modified)
+		}
+	}
+	resp, err := c.next.RoundTrip(outgoing)
+	if err != nil {
+		return nil, err
+	}
+	if entry != nil && resp.StatusCode == http.StatusNotModified {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+		refreshed := entry.revalidated(resp.Header, time.Now())
+		c.store(refreshed, req.Header)
+		return refreshed.response(req, time.Now()), nil
+	}
+	if c.storable(req, resp) {
+		resp.Body = &cacheFiller{ReadCloser: resp.Body, cache: c, resp: resp, requestHeader: req.Header.Clone(), url: resource}
+	}
+	return resp, nil
+}
+
+// storable applies the rules of a shared cache (RFC 9111 section 3): only complete 200 answers that a later request
+// can be served or revalidated from, that are not marked private, set no cookie and were not fetched with credentials
+// the response does not explicitly allow sharing.
+func (c *responseCache) storable(req *http.Request, resp *http.Response) bool {
+	if resp.StatusCode != http.StatusOK || resp.ContentLength > int64(c.maxObject) || resp.Header.Get("Set-Cookie") != "" {
+		return false
+	}
+	directives := cacheDirectives(resp.Header)
+	if _, ok := directives["no-store"]; ok {
+		return false
+	}
+	if _, ok := directives["private"]; ok {
+		return false
+	}
+	if req.Header.Get("Authorization") != "" {
+		_, public := directives["public"]
+		_, shared := directives["s-maxage"]
+		_, mustRevalidate := directives["must-revalidate"]
+		if !public && !shared && !mustRevalidate {
+			return false
+		}
+	}
+	for _, name := range varyNames(resp.Header) {
+		if name == "*" {
+			return false
+		}
+	}
+	return resp.Header.Get("ETag") != "" || resp.Header.Get("Last-Modified") != "" || freshnessLifetime(resp.Header, time.Now()) > 0
+}
+
+// lookup returns the stored response matching the request headers named by the URL's Vary, if any.
+func (c *responseCache) lookup(url string, header http.Header) *cachedResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[variantKey(url, c.varies[url], header)]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(element)
+	return element.Value.(*cachedResponse)
+}
+
+// store keeps entry under the variant selected by the request headers it was fetched with.
+func (c *responseCache) store(entry *cachedResponse, requestHeader http.Header) {
+	if len(entry.body) > c.maxBytes {
+		return
+	}
+	names := varyNames(entry.header)
+	entry.key = variantKey(entry.url, names, requestHeader)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[entry.key]; ok {
+		c.remove(element)
+	}
+	c.varies[entry.url] = names
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.size += len(entry.body)
+	for c.size > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove drops one entry; the caller holds mu. Other variants of its URL stay until they are evicted themselves,
+// but are no longer found once the URL's Vary names are forgotten.
+func (c *responseCache) remove(element *list.Element) {
+	entry := c.lru.Remove(element).(*cachedResponse)
+	delete(c.entries, entry.key)
+	delete(c.varies, entry.url)
+	c.size -= len(entry.body)
+}
+
+// variantKey extends url with the values of the request headers the response varies on.
+func variantKey(url string, names []string, header http.Header) string {
+	var key strings.Builder
+	key.WriteString(url)
+	for _, name := range names {
+		key.WriteString("\x00" + name + ":" + strings.Join(header.Values(name), ","))
+	}
+	return key.String()
+}
+
+// varyNames lists the Vary header names in canonical form.
+func varyNames(header http.Header) []string {
+	var names []string
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// cacheDirectives parses Cache-Control into lower-case directive names and their unquoted values.
+func cacheDirectives(header http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, argument, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name != "" {
+				directives[strings.ToLower(name)] = strings.Trim(argument, `"`)
+			}
+		}
+	}
+	return directives
+}
+
+// freshnessLifetime is how long a response may be served without asking the backend: s-maxage, then max-age, then
+// Expires. no-cache makes every use a revalidation, and responses without any of these are revalidated as well.
+func freshnessLifetime(header http.Header, now time.Time) time.Duration {
+	directives := cacheDirectives(header)
+	if _, ok := directives["no-cache"]; ok {
+		return 0
+	}
+	for _, name := range []string{"s-maxage", "max-age"} {
+		if value, ok := directives[name]; ok {
+			seconds, err := strconv.Atoi(value)
+			if err != nil || seconds < 0 {
+				return 0
+			}
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	if expires, err := http.ParseTime(header.Get("Expires")); err == nil {
+		date, err := http.ParseTime(header.Get("Date"))
+		if err != nil {
+			date = now
+		}
+		return max(expires.Sub(date), 0)
+	}
+	return 0
+}
+
+// newCachedResponse records a response received at now.
+func newCachedResponse(url string, status int, header http.Header, body []byte, now time.Time) *cachedResponse {
+	header = header.Clone()
+	age, _ := strconv.Atoi(header.Get("Age"))
+	return &cachedResponse{
+		url:      url,
+		status:   status,
+		header:   header,
+		body:     body,
+		stored:   now,
+		age:      time.Duration(max(age, 0)) * time.Second,
+		lifetime: freshnessLifetime(header, now),
+	}
+}
+
+// currentAge adds the time spent in this cache to the age the backend reported.
+func (e *cachedResponse) currentAge(now time.Time) time.Duration {
+	return e.age + now.Sub(e.stored)
+}
+
+// revalidated applies the headers of a 304 to the stored response (RFC 9111 section 4.3.4) and restarts its
+// freshness; the body, and the headers that describe it, stay as stored.
+func (e *cachedResponse) revalidated(notModified http.Header, now time.Time) *cachedResponse {
+	header := e.header.Clone()
+	for name, values := range notModified {
+		switch name {
+		case "Content-Length", "Content-Encoding", "Content-Range", "Transfer-Encoding":
+			continue
+		}
+		header[name] = values
+	}
+	if notModified.Get("Age") == "" {
+		header.Del("Age")
+	}
+	return newCachedResponse(e.url, e.status, header, e.body, now)
+}
+
+// response builds the answer to req from the stored copy.
+func (e *cachedResponse) response(req *http.Request, now time.Time) *http.Response {
+	header := e.header.Clone()
+	header.Set("Age", strconv.Itoa(int(e.currentAge(now).Seconds())))
+	header.Set("Content-Length", strconv.Itoa(len(e.body)))
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.status, http.StatusText(e.status)),
+		StatusCode:    e.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(e.body)),
+		ContentLength: int64(len(e.body)),
+		Request:       req,
+	}
+}
+
+// cacheFiller copies a response body as it is read and stores it once it has been read completely.
+type cacheFiller struct {
+	io.ReadCloser
+	cache         *responseCache
+	resp          *http.Response
+	requestHeader http.Header
+	url           string
+	body          []byte
+	skipped       bool
+}
+
+func (f *cacheFiller) Read(p []byte) (int, error) {
+	n, err := f.ReadCloser.Read(p)
+	if !f.skipped {
+		if len(f.body)+n > f.cache.maxObject {
+			f.skipped, f.body = true, nil
+		} else {
+			f.body = append(f.body, p[:n]...)
+		}
+	}
+	if err == io.EOF && !f.skipped && (f.resp.ContentLength < 0 || int64(len(f.body)) == f.resp.ContentLength) {
+		f.skipped = true
+		f.cache.store(newCachedResponse(f.url, f.resp.StatusCode, f.resp.Header, f.body, time.Now()), f.requestHeader)
+	}
+	return n, err
+}
+
+// cleartextHandler lets a plain HTTP listener also accept h2c, by prior knowledge or an "Upgrade: h2c" request.
+// h2c connections are taken over from net/http, so a graceful shutdown closes rather than drains them.
+func cleartextHandler(handler http.Handler, enableH2C bool) http.Handler {
+	if !enableH2C {
+		return handler
+	}
+	return h2c.NewHandler(handler, &http2.Server{})
+}
+
+// requireLocalIP fails unless ip is assigned to one of this host's interfaces, catching typos before the first dial does.
+func requireLocalIP(ip net.IP) error {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if network, ok := addr.(*net.IPNet); ok && network.IP.Equal(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not assigned to any local interface", ip)
+}
+
+// agedConn retires itself at the next request boundary after its lifetime ends.
+// Backends that silently drop old keep-alive connections then never see a request on a dead socket:
+// the write fails before any byte is sent, so the transport discards the connection and retries on a fresh one.
+type agedConn struct {
+	net.Conn
+	expires time.Time
+	// readSinceWrite marks a request boundary: the previous response was being read when the next request starts writing.
+	readSinceWrite atomic.Bool
+	wrote          atomic.Bool
+}
+
+// Read records that a response is being consumed.
+func (c *agedConn) Read(p []byte) (int, error) {
+	c.readSinceWrite.Store(true)
+	return c.Conn.Read(p)
+}
+
+// Write refuses to start a new request on an expired connection but never interrupts a request already being written.
+func (c *agedConn) Write(p []byte) (int, error) {
+	atBoundary := !c.wrote.Load() || c.readSinceWrite.Load()
+	if atBoundary && time.Now().After(c.expires) {
+		c.Conn.Close()
+		return 0, errUpstreamConnExpired
+	}
+	c.wrote.Store(true)
+	c.readSinceWrite.Store(false)
+	return c.Conn.Write(p)
+}
+
+// readPEM resolves a --tls-cert/--tls-key value into PEM bytes.
+// Inline PEM (starting with -----BEGIN) and env:NAME references keep key material off disk for orchestrators that inject secrets as variables.
+func readPEM(value string) ([]byte, error) {
+	if strings.HasPrefix(strings.TrimSpace(value), "-----BEGIN") {
+		return []byte(value), nil
+	}
+	if name, ok := strings.CutPrefix(value, "env:"); ok {
+		content := os.Getenv(name)
+		if content == "" {
+			return nil, fmt.Errorf("environment variable %s is empty or unset", name)
+		}
+		return []byte(content), nil
+	}
+	return os.ReadFile(value)
+}
+
+// loadKeyPair builds a certificate from --tls-cert/--tls-key, whichever form each of them uses.
+func loadKeyPair(certValue, keyValue string) (tls.Certificate, error) {
+	certPEM, err := readPEM(certValue)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("read certificate: %w", err)
+	}
+	keyPEM, err := readPEM(keyValue)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("read key: %w", err)
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// certReloadCheckInterval throttles mtime checks so a handshake burst does not turn into a stat() storm.
+const certReloadCheckInterval = time.Second
+
+// certReloader serves the static key pair through GetCertificate and swaps it when the files change or on SIGHUP.
+// Renewals by certbot or cert-manager then take effect for new handshakes without dropping existing connections.
+type certReloader struct {
+	certValue string
+	keyValue  string
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+// newCertReloader loads the pair once so startup still fails fast on a broken certificate.
+func newCertReloader(certValue, keyValue string) (*certReloader, error) {
+	c := &certReloader{certValue: certValue, keyValue: keyValue}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload re-reads the pair and only replaces the served certificate when it parses, so a half-written renewal never breaks TLS.
+func (c *certReloader) reload() error {
+	modTime := c.filesModTime()
+	pair, err := loadKeyPair(c.certValue, c.keyValue)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.cert = &pair
+	c.modTime = modTime
+	c.mu.Unlock()
+	return nil
+}
+
+// filesModTime returns the newest mtime of the cert and key files; inline PEM and env values never change and report zero.
+func (c *certReloader) filesModTime() time.Time {
+	var newest time.Time
+	for _, value := range []string{c.certValue, c.keyValue} {
+		if strings.HasPrefix(strings.TrimSpace(value), "-----BEGIN") || strings.HasPrefix(value, "env:") {
+			continue
+		}
+		if info, err := os.Stat(value); err == nil && info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+	}
+	return newest
+}
+
+// GetCertificate implements tls.Config.GetCertificate, reloading first when the files on disk changed since the cached pair was read.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	due := time.Since(c.lastCheck) >= certReloadCheckInterval
+	if due {
+		c.lastCheck = time.Now()
+	}
+	cached := c.modTime
+	c.mu.Unlock()
+
+	if due && !c.filesModTime().Equal(cached) {
+		if err := c.reload(); err != nil {
+			log.Printf("Error reloading TLS certificate, keeping the previous one: %v", err)
+		} else {
+			log.Printf("TLS certificate reloaded from %s", c.certValue)
+		}
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// certSet holds every static certificate and picks the one matching the client's SNI, falling back to the first pair.
+type certSet []*certReloader
+
+// GetCertificate implements tls.Config.GetCertificate across all pairs so each one keeps reloading independently.
+func (set certSet) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	var fallback *tls.Certificate
+	for i, reloader := range set {
+		cert, err := reloader.GetCertificate(hello)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			fallback = cert
+		}
+		// SupportsCertificate checks SNI against the certificate names as well as key type compatibility.
+		if hello.SupportsCertificate(cert) == nil {
+			return cert, nil
+		}
+	}
+	return fallback, nil
+}
+
+// reloadOnSignal reloads every certificate on SIGHUP for deployments that prefer explicit reloads over mtime polling.
+// onReload, if set, runs after a signal reloaded at least one certificate.
+func (set certSet) reloadOnSignal(onReload func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		reloaded := false
+		for _, reloader := range set {
+			if err := reloader.reload(); err != nil {
+				log.Printf("Error reloading TLS certificate %s on SIGHUP, keeping the previous one: %v", reloader.certValue, err)
+				continue
+			}
+			reloaded = true
+			log.Printf("TLS certificate reloaded on SIGHUP from %s", reloader.certValue)
+		}
+		if reloaded && onReload != nil {
+			onReload()
+		}
+	}
+}
+
+// idleConnTracker remembers which server connections are idle via http.Server.ConnState.
+// net/http closes idle HTTP/1 connections itself when keep-alives are disabled, but not idle HTTP/2 ones (golang.org/issue/26303).
+type idleConnTracker struct {
+	mu   sync.Mutex
+	idle map[net.Conn]bool
+}
+
+// track implements the http.Server.ConnState hook.
+func (t *idleConnTracker) track(conn net.Conn, state http.ConnState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch state {
+	case http.StateIdle:
+		t.idle[conn] = true
+	case http.StateActive:
+		t.idle[conn] = false
+	case http.StateClosed, http.StateHijacked:
+		delete(t.idle, conn)
+	}
+}
+
+// closeIdle closes every connection that has no request in flight.
+func (t *idleConnTracker) closeIdle() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for conn, idle := range t.idle {
+		if idle {
+			conn.Close()
+		}
+	}
+}
+
+// drainKeepAlives forces clients onto new TLS handshakes after a key rotation: idle keep-alive connections close at once,
+// busy ones close after their in-flight response (HTTP/2 via GOAWAY), and keep-alives come back once the window has passed.
+func drainKeepAlives(server *http.Server, conns *idleConnTracker, window time.Duration) {
+	log.Printf("Draining HTTPS keep-alive connections for %s after certificate reload", window)
+	server.SetKeepAlivesEnabled(false)
+	conns.closeIdle()
+	time.Sleep(window)
+	server.SetKeepAlivesEnabled(true)
+	log.Printf("HTTPS keep-alive connections re-enabled")
+}
+
+// stringList collects a repeatable flag in the order given on the command line.
+type stringList []string
+
+// String implements flag.Value.
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+// Set implements flag.Value by appending each occurrence.
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// sessionTicketKeysKept bounds how many retired ticket keys stay valid for resumption after a rotation.
+const sessionTicketKeysKept = 3
+
+// rotateSessionTicketKeys installs a fresh session ticket key every interval so a leaked key only exposes a short window of sessions.
+// The newest key encrypts new tickets while the previous ones still decrypt, keeping resumption working across rotations.
+func rotateSessionTicketKeys(cfg *tls.Config, interval time.Duration) {
+	var keys [][32]byte
+	for {
+		var key [32]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			log.Printf("Error generating session ticket key: %v", err)
+		} else {
+			keys = append([][32]byte{key}, keys...)
+			if len(keys) > sessionTicketKeysKept {
+				keys = keys[:sessionTicketKeysKept]
+			}
+			cfg.SetSessionTicketKeys(keys)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// listenerConfig holds the connection-level protections applied to every listener before HTTP parsing starts.
+type listenerConfig struct {
+	maxConnsPerIP int
+	acceptBackoff time.Duration
+	// network is "tcp" for dual-stack or "tcp4"/"tcp6" to bind a single address family.
+	network string
+	// noDelay, readBuffer and writeBuffer tune accepted sockets; buffer sizes of 0 keep the kernel's autotuning.
+	noDelay     bool
+	readBuffer  int
+	writeBuffer int
+}
+
+// listen binds addr and wraps the raw listener with the configured protections.
+func (lc listenerConfig) listen(addr string) (net.Listener, error) {
+	listener, err := net.Listen(lc.network, addr)
+	if err != nil {
+		return nil, err
+	}
+	// Go already disables Nagle on every TCP connection, so only deviations from that and the kernel defaults need a wrapper.
+	if !lc.noDelay || lc.readBuffer > 0 || lc.writeBuffer > 0 {
+		listener = &tunedListener{Listener: listener, noDelay: lc.noDelay, readBuffer: lc.readBuffer, writeBuffer: lc.writeBuffer}
+	}
+	if lc.acceptBackoff > 0 {
+		listener = &resilientListener{Listener: listener, backoff: lc.acceptBackoff}
+	}
+	if lc.maxConnsPerIP > 0 {
+		listener = &perIPListener{Listener: listener, limit: lc.maxConnsPerIP, active: make(map[string]int)}
+	}
+	return listener, nil
+}
+
+// tunedListener applies socket options to each accepted connection before any other wrapper hides the *net.TCPConn.
+type tunedListener struct {
+	net.Listener
+	noDelay     bool
+	readBuffer  int
+	writeBuffer int
+}
+
+// Accept sets TCP_NODELAY and the socket buffer sizes; a failure is logged and the connection served with defaults.
+func (l *tunedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return conn, err
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return conn, nil
+	}
+	if err := tcpConn.SetNoDelay(l.noDelay); err != nil {
+		log.Printf("Error setting TCP_NODELAY for %s: %v", conn.RemoteAddr(), err)
+	}
+	if l.readBuffer > 0 {
+		if err := tcpConn.SetReadBuffer(l.readBuffer); err != nil {
+			log.Printf("Error setting read buffer for %s: %v", conn.RemoteAddr(), err)
+		}
+	}
+	if l.writeBuffer > 0 {
+		if err := tcpConn.SetWriteBuffer(l.writeBuffer); err != nil {
+			log.Printf("Error setting write buffer for %s: %v", conn.RemoteAddr(), err)
+		}
+	}
+	return conn, nil
+}
+
+// maxAcceptBackoff caps the retry delay so the listener recovers within a second once descriptors free up.
+const maxAcceptBackoff = time.Second
+
+// resilientListener rides out transient accept failures such as descriptor exhaustion during connection storms.
+// Only these errors are retried; anything else still reaches the server and stops it.
+type resilientListener struct {
+	net.Listener
+	backoff time.Duration
+}
+
+// Accept retries transient errors with exponential backoff instead of handing them to the HTTP server.
+func (l *resilientListener) Accept() (net.Conn, error) {
+	delay := l.backoff
+	for {
+		conn, err := l.Listener.Accept()
+		if err == nil || !isTransientAcceptError(err) {
+			return conn, err
+		}
+		log.Printf("Transient accept error: %v; retrying in %s", err, delay)
+		time.Sleep(delay)
+		delay = min(delay*2, maxAcceptBackoff)
+	}
+}
+
+// isTransientAcceptError reports errors caused by momentary resource pressure or by clients that vanished mid-handshake.
+func isTransientAcceptError(err error) bool {
+	for _, errno := range []syscall.Errno{syscall.EMFILE, syscall.ENFILE, syscall.ECONNABORTED, syscall.ECONNRESET, syscall.ENOBUFS, syscall.ENOMEM} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// perIPListener caps concurrent TCP connections per client IP so one host cannot exhaust sockets with idle connections.
+// It sits below TLS and HTTP, so rejected peers cost us nothing beyond the accept itself.
+type perIPListener struct {
+	net.Listener
+	limit  int
+	mu     sync.Mutex
+	active map[string]int
+}
+
+// Accept drops connections above the per-IP limit and keeps looping so the server never sees them.
+func (l *perIPListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		ip := conn.RemoteAddr().String()
+		if host, _, err := net.SplitHostPort(ip); err == nil {
+			ip = host
+		}
+
+		l.mu.Lock()
+		if l.active[ip] >= l.limit {
+			l.mu.Unlock()
+			conn.Close()
+			continue
+		}
+		l.active[ip]++
+		l.mu.Unlock()
+
+		return &countedConn{Conn: conn, release: func() { l.release(ip) }}, nil
+	}
+}
+
+// release forgets one connection for ip and deletes empty entries so the map does not grow with every visitor.
+func (l *perIPListener) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active[ip]--
+	if l.active[ip] <= 0 {
+		delete(l.active, ip)
+	}
+}
+
+// countedConn gives its slot back exactly once, however many times Close is called.
+type countedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+// Close closes the connection and releases its per-IP slot.
+func (c *countedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// handshakeListener completes every TLS handshake in its own goroutine under a deadline before the HTTP server sees the connection.
+// net/http only bounds handshakes through its read and write timeouts, which would also cap slow but legitimate requests;
+// here a client stalling mid-handshake is simply dropped once the deadline passes.
+type handshakeListener struct {
+	net.Listener
+	config    *tls.Config
+	timeout   time.Duration
+	ready     chan net.Conn
+	failed    chan error
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// newHandshakeListener wraps a raw TCP listener and starts accepting from it.
+func newHandshakeListener(inner net.Listener, config *tls.Config, timeout time.Duration) *handshakeListener {
+	l := &handshakeListener{
+		Listener: inner,
+		config:   config,
+		timeout:  timeout,
+		ready:    make(chan net.Conn),
+		failed:   make(chan error),
+		closed:   make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+// acceptLoop hands raw connections to handshake goroutines so one slow client never delays the next accept.
+func (l *handshakeListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.failed <- err:
+			case <-l.closed:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go l.handshake(conn)
+	}
+}
+
+// handshake runs the TLS handshake under the deadline and queues the connection for Accept once it succeeded.
+func (l *handshakeListener) handshake(conn net.Conn) {
+	tlsConn := tls.Server(conn, l.config)
+	ctx, cancel := context.WithTimeout(context.Background(), l.timeout)
+	defer cancel()
+
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		// Keep the hint net/http gives to clients that speak plain HTTP to the HTTPS port.
+		var recordErr tls.RecordHeaderError
+		if errors.As(err, &recordErr) && recordErr.Conn != nil && looksLikeHTTP(recordErr.RecordHeader[:]) {
+			io.WriteString(recordErr.Conn, "HTTP/1.0 400 Bad Request\r\n\r\nClient sent an HTTP request to an HTTPS server.\n")
+		}
+		log.Printf("TLS handshake error from %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	select {
+	case l.ready <- tlsConn:
+	case <-l.closed:
+		tlsConn.Close()
+	}
+}
+
+// looksLikeHTTP reports whether the first bytes of a TLS record are really the start of a plain HTTP request.
+func looksLikeHTTP(header []byte) bool {
+	for _, method := range []string{"GET /", "HEAD ", "POST ", "PUT /", "OPTIO"} {
+		if strings.HasPrefix(string(header), method) {
+			return true
+		}
+	}
+	return false
+}
+
+// Accept returns the next connection whose handshake has completed.
+func (l *handshakeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.ready:
+		return conn, nil
+	case err := <-l.failed:
+		return nil, err
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting and releases connections still waiting in a handshake goroutine.
+func (l *handshakeListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return l.Listener.Close()
+}
+
+// reportFatal prints failures to both standard streams so systemd surfaces them no matter how the unit is configured.
+// We keep logging in place to preserve historical behaviour while still exiting immediately after an unrecoverable error.
+func reportFatal(message string) {
+	fmt.Fprintln(os.Stdout, message)
+	fmt.Fprintln(os.Stderr, message)
+	log.Println(message)
+	flushLogs()
+}
+
+// exitWithError wraps contextual failures, reports them loudly, and terminates to avoid partial startup states.
+// Writing to STDOUT, STDERR, and the logger guarantees visibility across manual runs and systemd invocations.
+func exitWithError(context string, err error) {
+	message := fmt.Sprintf("%s: %v", context, err)
+	reportFatal(message)
+	os.Exit(1)
+}
+
+// shutdownStages orders the proxy listeners for a graceful shutdown; httpServers holds every plain HTTP listener.
+// Stopping HTTP first lets load balancer health checks fail while HTTPS keeps serving its existing connections.
+func shutdownStages(order string, httpServers []*http.Server, httpsServer *http.Server) [][]*http.Server {
+	switch order {
+	case "http-first":
+		return [][]*http.Server{httpServers, {httpsServer}}
+	case "https-first":
+		return [][]*http.Server{{httpsServer}, httpServers}
+	default:
+		return [][]*http.Server{append(httpServers, httpsServer)}
+	}
+}
+
+// shutdownInStages shuts each stage down concurrently, waiting drainDelay between the first drained stages so upstream
+// balancers notice; later stages, such as the admin listener, follow at once. Nil servers are skipped, and so is the
+// wait before a stage that has none. Every server gets at most timeout to finish in-flight requests before its
+// connections are closed.
+func shutdownInStages(stages [][]*http.Server, drained int, drainDelay, timeout time.Duration) {
+	for i, stage := range stages {
+		var wg sync.WaitGroup
+		stopped := 0
+		for _, server := range stage {
+			if server == nil {
+				continue
+			}
+			stopped++
+			wg.Add(1)
+			go func(server *http.Server) {
+				defer wg.Done()
+				ctx, cancel := context.WithTimeout(context.Background(), timeout)
+				defer cancel()
+				if err := server.Shutdown(ctx); err != nil {
+					log.Printf("Error shutting down listener %s: %v", server.Addr, err)
+					server.Close()
+					return
+				}
+				log.Printf("Listener %s stopped", server.Addr)
+			}(server)
+		}
+		wg.Wait()
+
+		if stopped == 0 || drainDelay <= 0 || i+1 >= min(drained, len(stages)) {
+			continue
+		}
+		if slices.ContainsFunc(stages[i+1], func(server *http.Server) bool { return server != nil }) {
+			time.Sleep(drainDelay)
+		}
+	}
+}
+
+// bindOrExit binds a listener during startup so port conflicts surface before anything is announced as listening.
+// The common causes get a precise, colored one-line explanation instead of a raw syscall error.
+func bindOrExit(label, addr string, bind func(string) (net.Listener, error)) net.Listener {
+	listener, err := bind(addr)
+	if err == nil {
+		return listener
+	}
+
+	message := fmt.Sprintf("%s: failed to listen on %s: %v", label, addr, err)
+	switch {
+	case errors.Is(err, syscall.EADDRINUSE):
+		message = fmt.Sprintf("%s: %s already in use", label, describeAddr(addr))
+	case errors.Is(err, syscall.EACCES):
+		message = fmt.Sprintf("%s: permission denied for %s (ports below 1024 need root)", label, describeAddr(addr))
+	}
+	fmt.Fprintf(os.Stdout, "%s%s%s\n", colorError, message, colorReset)
+	fmt.Fprintf(os.Stderr, "%s%s%s\n", colorError, message, colorReset)
+	log.Println(message)
+	os.Exit(1)
+	return nil
+}
+
+// describeAddr renders ":443" as "port 443" and keeps explicit hosts visible.
+func describeAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if host == "" {
+		return "port " + port
+	}
+	return fmt.Sprintf("port %s on %s", port, host)
+}
+
+// portMapping is one --listen entry: a plain HTTP listener forwarding to its own backend.
+type portMapping struct {
+	addr   string
+	target *url.URL
+	user   *url.Userinfo
+}
+
+// parsePortMapping parses "PORT=URL" or "HOST:PORT=URL"; credentials in the URL are split off like those of --target-url.
+func parsePortMapping(value string) (portMapping, error) {
+	addr, rawTarget, ok := strings.Cut(value, "=")
+	if !ok {
+		return portMapping{}, fmt.Errorf("expected PORT=URL, got %q", value)
+	}
+	if !strings.Contains(addr, ":") {
+		addr = ":" + addr
+	}
+	if _, port, err := net.SplitHostPort(addr); err != nil || port == "" {
+		return portMapping{}, fmt.Errorf("invalid listen address in %q", value)
+	}
+	target, err := url.Parse(rawTarget)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return portMapping{}, fmt.Errorf("invalid target URL in %q", value)
+	}
+	user := target.User
+	target.User = nil
+	return portMapping{addr: addr, target: target, user: user}, nil
+}
+
+// mappingConfig derives the configuration of a --listen or --listen-file listener: everything is shared except the
+// backend, and the canary split, hash ring and default target, which name backends of the main listener, are left out.
+func mappingConfig(base proxyConfig, mapping portMapping) proxyConfig {
+	cfg := base
+	cfg.targetURL = strings.TrimSuffix(mapping.target.String(), "/")
+	cfg.upstreamHost = mapping.target.Host
+	cfg.upstreamUser = mapping.user
+	cfg.canaryURL = ""
+	cfg.hashRing = nil
+	cfg.defaultTargetURL = ""
+	return cfg
+}
+
+// readListenFile parses a --listen-file: one PORT=URL or HOST:PORT=URL mapping per line, with blank lines and
+// # comments ignored. scheme, when set, replaces each backend's scheme like --upstream-scheme does for --listen.
+func readListenFile(filePath, scheme string) ([]portMapping, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	var mappings []portMapping
+	seen := make(map[string]bool)
+	for number, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		mapping, err := parsePortMapping(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", number+1, err)
+		}
+		if seen[mapping.addr] {
+			return nil, fmt.Errorf("line %d: %s is listed twice", number+1, mapping.addr)
+		}
+		seen[mapping.addr] = true
+		if scheme != "" {
+			mapping.target.Scheme = scheme
+		}
+		mappings = append(mappings, mapping)
+	}
+	return mappings, nil
+}
+
+// listenFile runs the listeners of a --listen-file. On SIGHUP it re-reads the file and changes only what differs:
+// new addresses are bound, removed ones shut down gracefully, and a changed backend is swapped in place, so
+// connections on every other listener, and on the retargeted one, are never interrupted.
+type listenFile struct {
+	path            string
+	scheme          string
+	base            proxyConfig
+	bind            func(string) (net.Listener, error)
+	enableH2C       bool
+	shutdownTimeout time.Duration
+
+	mu      sync.Mutex
+	running map[string]*fileListener
+}
+
+// fileListener is one running --listen-file entry; handler holds the proxy for its current backend.
+type fileListener struct {
+	target  string
+	server  *http.Server
+	handler atomic.Value
+	// closed closes once the listening socket is gone and its address can be bound again.
+	closed chan struct{}
+}
+
+// closeSignalListener reports through closed when it has been closed.
+type closeSignalListener struct {
+	net.Listener
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (l *closeSignalListener) Close() error {
+	err := l.Listener.Close()
+	l.once.Do(func() { close(l.closed) })
+	return err
+}
+
+// start serves mapping on an already bound listener.
+func (lf *listenFile) start(mapping portMapping, listener net.Listener) {
+	entry := &fileListener{target: mapping.target.String(), closed: make(chan struct{})}
+	listener = &closeSignalListener{Listener: listener, closed: entry.closed}
+	entry.handler.Store(proxyHandler(mappingConfig(lf.base, mapping)))
+	entry.server = &http.Server{
+		Addr: mapping.addr,
+		Handler: cleartextHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			entry.handler.Load().(http.HandlerFunc).ServeHTTP(w, r)
+		}), lf.enableH2C),
+	}
+	lf.running[mapping.addr] = entry
+	go func() {
+		log.Printf("Starting HTTP proxy on port %s targeting %s", listenerPort(listener), mapping.target)
+		// Failures here are not fatal: the listener is reload-managed, and the next SIGHUP can bind it again.
+		if err := entry.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("Error serving HTTP on %s: %v", mapping.addr, err)
+			lf.mu.Lock()
+			if lf.running[mapping.addr] == entry {
+				delete(lf.running, mapping.addr)
+			}
+			lf.mu.Unlock()
+		}
+	}()
+}
+
+// reload applies the current file contents. A file that cannot be read or parsed leaves every listener as it is.
+func (lf *listenFile) reload() {
+	mappings, err := readListenFile(lf.path, lf.scheme)
+	if err != nil {
+		log.Printf("Error reloading listen file %s, keeping the current listeners: %v", lf.path, err)
+		return
+	}
+
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	wanted := make(map[string]portMapping, len(mappings))
+	for _, mapping := range mappings {
+		wanted[mapping.addr] = mapping
+	}
+
+	var removed []*http.Server
+	var released []chan struct{}
+	for addr, entry := range lf.running {
+		if _, ok := wanted[addr]; !ok {
+			delete(lf.running, addr)
+			removed = append(removed, entry.server)
+			released = append(released, entry.closed)
+		}
+	}
+	// Removed listeners drain exactly as they would on SIGTERM, without holding up the rest of the reload. Shutdown
+	// closes the listening sockets first, and only that part is waited for, so a line that moved to another spelling
+	// of the same port (8080 to 0.0.0.0:8080) can bind it below while old connections are still finishing.
+	if len(removed) > 0 {
+		go shutdownInStages([][]*http.Server{removed}, 1, 0, lf.shutdownTimeout)
+		for _, closed := range released {
+			<-closed
+		}
+	}
+
+	for addr, mapping := range wanted {
+		if entry, ok := lf.running[addr]; ok {
+			if target := mapping.target.String(); target != entry.target {
+				entry.handler.Store(proxyHandler(mappingConfig(lf.base, mapping)))
+				entry.target = target
+				log.Printf("HTTP proxy on %s now targeting %s", describeAddr(addr), mapping.target)
+			}
+			continue
+		}
+		listener, err := lf.bind(addr)
+		if err != nil {
+			log.Printf("Error listening on %s from %s, skipping it until the next reload: %v", describeAddr(addr), lf.path, err)
+			continue
+		}
+		lf.start(mapping, listener)
+	}
+}
+
+// reloadOnSignal re-reads the file on every SIGHUP.
+func (lf *listenFile) reloadOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		log.Printf("Reloading listen file %s on SIGHUP", lf.path)
+		lf.reload()
+	}
+}
+
+// servers lists the running listeners for the final shutdown.
+func (lf *listenFile) servers() []*http.Server {
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+	servers := make([]*http.Server, 0, len(lf.running))
+	for _, entry := range lf.running {
+		servers = append(servers, entry.server)
+	}
+	return servers
+}
+
+// parseBackendTimeout splits a --backend-timeout value of the form BACKEND=DURATION, where BACKEND is a URL
+// such as http://10.0.0.2:9000 or just its host and port. The key is the host as it appears in the backend URL.
+func parseBackendTimeout(value string) (string, time.Duration, error) {
+	backend, rawTimeout, ok := strings.Cut(value, "=")
+	if !ok {
+		return "", 0, fmt.Errorf("expected BACKEND=DURATION, got %q", value)
+	}
+	host := backend
+	if strings.Contains(backend, "://") {
+		target, err := url.Parse(backend)
+		if err != nil || target.Host == "" {
+			return "", 0, fmt.Errorf("invalid backend URL in %q", value)
+		}
+		host = target.Host
+	}
+	if host == "" || strings.ContainsAny(host, "/?#@") {
+		return "", 0, fmt.Errorf("invalid backend in %q", value)
+	}
+	timeout, err := time.ParseDuration(rawTimeout)
+	if err != nil || timeout < 0 {
+		return "", 0, fmt.Errorf("invalid duration in %q", value)
+	}
+	return strings.ToLower(host), timeout, nil
+}
+
+// writePIDFile records this process in path for init scripts and supervisors.
+// An existing file whose process is gone is treated as stale and replaced; a live one is only overwritten with force.
+func writePIDFile(path string, force bool) error {
+	for attempt := 0; attempt < 2; attempt++ {
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = fmt.Fprintf(file, "%d\n", os.Getpid())
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+			return err
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return err
+		}
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+		if err == nil && pid != os.Getpid() && processRunning(pid) && !force {
+			return fmt.Errorf("%s belongs to running process %d (use --force to take it over)", path, pid)
+		}
+		log.Printf("Replacing stale PID file %s", path)
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return fmt.Errorf("%s was recreated by another process", path)
+}
+
+// removePIDFile deletes the PID file on exit, but only while it still names this process.
+func removePIDFile(path string) {
+	content, err := os.ReadFile(path)
+	if err != nil || strings.TrimSpace(string(content)) != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	if err := os.Remove(path); err != nil {
+		log.Printf("Error removing PID file %s: %v", path, err)
+	}
+}
+
+// processRunning reports whether pid still exists; signal 0 probes without delivering anything.
+// Platforms without signal 0 (Windows) only get here if FindProcess found the process, so it counts as running.
+func processRunning(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	return !errors.Is(process.Signal(syscall.Signal(0)), os.ErrProcessDone)
+}
+
+// waitForResolvable retries the lookup with exponential backoff (capped at 5s) until host resolves or timeout passes.
+// IP literals return at once since there is nothing to resolve.
+func waitForResolvable(host string, timeout time.Duration) error {
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	delay := 100 * time.Millisecond
+	for {
+		_, err := net.DefaultResolver.LookupHost(ctx, host)
+		if err == nil {
+			return nil
+		}
+		log.Printf("Waiting for %s to resolve: %v; retrying in %s", host, err, delay)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s still unresolvable after %s: %w", host, timeout, err)
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, 5*time.Second)
+	}
+}
+
+// listenerPort reports the port a listener actually bound, which differs from the flag when it asked for port 0.
+// Integration tests start the binary with --http-port=0 and read the chosen port from the startup log.
+func listenerPort(listener net.Listener) string {
+	if addr, ok := listener.Addr().(*net.TCPAddr); ok {
+		return strconv.Itoa(addr.Port)
+	}
+	return listener.Addr().String()
+}
+
+// newUpstreamClient wraps the upstream transport in the client shared by every proxied request.
+// Redirects are followed by the handler, which keeps cookies, credentials and the hop limit under its control.
+func newUpstreamClient(transport http.RoundTripper) *http.Client {
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// bannerRow is one labelled line of the startup banner.
+type bannerRow struct {
+	label string
+	value string
+}
+
+// printStartupBanner summarises the effective configuration in one block once every listener is bound, so the
+// ports shown are the ones actually serving. Colors are only used on a terminal, keeping journald and log files clean.
+func printStartupBanner(rows []bannerRow) {
+	colorize := func(code, text string) string { return text }
+	if info, err := os.Stdout.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		colorize = func(code, text string) string { return code + text + colorReset }
+	}
+	width := 0
+	for _, row := range rows {
+		width = max(width, len(row.label))
+	}
+	var banner strings.Builder
+	fmt.Fprintf(&banner, "%s %s\n", colorize(colorTitle, "chicha-http-proxy"), colorize(colorHighlight, version))
+	for _, row := range rows {
+		fmt.Fprintf(&banner, "  %s%s %s\n", colorize(colorSection, row.label), strings.Repeat(" ", width-len(row.label)), row.value)
+	}
+	fmt.Print(banner.String())
+}
+
+func main() {
+	// Custom usage function keeps the CLI friendly and shows minimal and advanced recipes.
+	flag.Usage = func() {
+		fmt.Printf("%sChicha HTTP Proxy%s\n", colorTitle, colorReset)
+		fmt.Printf("%sMinimalist reverse proxy with optional automatic TLS.%s\n\n", colorDescription, colorReset)
+
+		fmt.Printf("%sUsage%s\n", colorSection, colorReset)
+		fmt.Printf("  chicha-http-proxy [flags]\n\n")
+
+		fmt.Printf("%sFlags%s\n", colorSection, colorReset)
+		flag.VisitAll(func(f *flag.Flag) {
+			fmt.Printf("  %s--%s%s %s%s%s\n",
+				colorHighlight, f.Name, colorReset,
+				colorDescription, f.Usage, colorReset,
+			)
+		})
+		fmt.Println()
+
+		fmt.Printf("%sQuick Start%s\n", colorSection, colorReset)
+		fmt.Printf("  %sMinimal:%s chicha-http-proxy --target-url https://example.com\n", colorHighlight, colorReset)
+		fmt.Printf("  %sAdvanced:%s chicha-http-proxy --target-url https://example.com --http-port 8080 --domain proxy.example.com --https-port 8443\n", colorHighlight, colorReset)
+		fmt.Println()
+
+		fmt.Printf("%sNotes%s\n", colorSection, colorReset)
+		fmt.Printf("  %s• Certificates fetched automatically when --domain is set.%s\n", colorDescription, colorReset)
+		fmt.Printf("  %s• Upstream TLS verification is disabled intentionally for trust-on-first-use scenarios.%s\n\n", colorDescription, colorReset)
+	}
+
+	// Define command-line flags
+	httpPort := flag.String("http-port", "80", "Port for the HTTP server. If -domain is set, this is forced to 80.")
+	httpsPort := flag.String("https-port", "443", "Port for the HTTPS server (only used if -domain is set).")
+	targetURL := flag.String("target-url", "https://twochicks.ru", "Target URL for forwarding requests.")
+	domain := flag.String("domain", "", "Domain for automatic Let's Encrypt certificate. Forces HTTP port to 80 and admin rights, HTTPS can be changed.")
+	canonicalHost := flag.String("canonical-host", "", "Redirect (301) to one hostname form: 'apex' sends www.example.com to example.com, 'www' does the reverse. Empty disables it.")
+	canaryTarget := flag.String("canary-target", "", "Second backend URL receiving --canary-percent of clients for canary rollouts.")
+	canaryPercent := flag.Int("canary-percent", 0, "Percentage of clients (0-100) routed to --canary-target. Each client stays on one variant, logged as $variant in --access-log-format and \"variant\" in --access-log-file.")
+	canaryCookie := flag.String("canary-cookie", "", "Cookie whose value identifies a client for canary stickiness, e.g. a session cookie. Falls back to the client IP.")
+	hashHeader := flag.String("hash-header", "", "Request header (e.g. X-Tenant-Id) whose value picks a --hash-backend by consistent hashing, so one value always reaches the same backend. Requests without it go to --target-url.")
+	var hashBackendValues stringList
+	flag.Var(&hashBackendValues, "hash-backend", "Backend in the --hash-header ring, as URL or URL=WEIGHT (1-100, default 1). List --target-url too if it should take a share. Repeatable.")
+	upstreamScheme := flag.String("upstream-scheme", "", "Force 'http' or 'https' towards the backend regardless of the --target-url scheme.")
+	hostModeFlag := flag.String("host-mode", "domain", "Controls which host is forwarded upstream: 'domain' keeps the public name, 'target' preserves the backend host.")
+	addPathPrefix := flag.String("add-path-prefix", "", "Prefix prepended to every forwarded path, e.g. /app serves the backend from /app/...")
+	stripPathPrefix := flag.String("strip-path-prefix", "", "Prefix removed from incoming paths before forwarding, e.g. /api turns /api/users into /users.")
+	prefixMiss := flag.String("strip-prefix-miss", "pass", "Behaviour when --strip-path-prefix does not match and there is no --default-target: 'pass' forwards the path unchanged, 'reject' answers --no-route-status.")
+	defaultTarget := flag.String("default-target", "", "Backend URL receiving paths outside --strip-path-prefix, with their path unchanged.")
+	noRouteStatus := flag.Int("no-route-status", http.StatusNotFound, "Status answered for paths outside --strip-path-prefix with --strip-prefix-miss=reject and no --default-target.")
+	trailingSlash := flag.String("trailing-slash", "preserve", "Trailing slash policy for request paths: 'add', 'remove' or 'preserve'. The root path and file-like paths (style.css) are never changed by 'add'.")
+	normalizePath := flag.Bool("normalize-path", false, "Resolve dot segments (/a/../b, including %2e) and collapse duplicate slashes before prefix, trailing-slash and audit matching.")
+	normalizePathMode := flag.String("normalize-path-mode", "forward", "How --normalize-path is applied: 'forward' also sends the normalised path upstream, 'route' only uses it for matching and forwards the client's path.")
+	trailingSlashMode := flag.String("trailing-slash-mode", "redirect", "How --trailing-slash is applied: 'redirect' answers 301 (308 for non-GET) to the corrected URL, 'rewrite' fixes the forwarded path silently.")
+	remapStatus := flag.String("remap-status", "", "Translate upstream status codes before replying, e.g. '500=502,418=503'.")
+	remapStatusBody := flag.Bool("remap-status-body", false, "Replace the body of remapped responses with the new status text instead of passing the upstream body through. A --status-body for the upstream status takes precedence.")
+	logHeaders := flag.Bool("log-headers", false, "Log the headers of every forwarded request and upstream response. Debugging aid; sensitive values are redacted.")
+	var stripResponseHeaders, allowResponseHeaders stringList
+	flag.Var(&stripResponseHeaders, "strip-response-header", "Upstream response header removed before the response reaches the client, e.g. X-Powered-By. Case-insensitive; repeatable.")
+	securityPreset := flag.String("security-headers", "", "Add a bundle of security headers to responses: 'basic' (safe for most sites) or 'strict'. Headers the backend already sends are kept. See the README for the exact values.")
+	var securityHeaderOverrides stringList
+	flag.Var(&securityHeaderOverrides, "security-header", "Set a response header, replacing the --security-headers value and the backend's, as NAME=VALUE; NAME= removes it. Repeatable.")
+	handleOptions := flag.Bool("handle-options-locally", false, "Answer OPTIONS requests with 204 without forwarding them, e.g. CORS preflights for an API whose CORS policy lives at the edge.")
+	optionsAllow := flag.String("options-allow", "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS", "Allow header of OPTIONS answers from --handle-options-locally.")
+	var statusBodyValues stringList
+	flag.Var(&statusBodyValues, "status-body", "Replace the body of upstream responses with this status, keeping the status, as CODE=TEXT or CODE=@PATH (content type from the file extension), e.g. 500=@/etc/chicha/500.html. Repeatable.")
+	var optionsHeaderValues stringList
+	flag.Var(&optionsHeaderValues, "options-header", "Extra header of OPTIONS answers from --handle-options-locally, as NAME=VALUE, e.g. Access-Control-Allow-Origin=https://app.example.com. Repeatable.")
+	flag.Var(&allowResponseHeaders, "allow-response-header", "Pass only these upstream response headers (plus Content-Length, Content-Encoding and other body framing) to clients. Case-insensitive; repeatable.")
+	var auditPaths, auditRedactFields stringList
+	flag.Var(&auditPaths, "audit-path", "Path prefix whose request bodies are written to --audit-log-file, e.g. /api/transactions. Whole segments; repeatable.")
+	flag.Var(&auditRedactFields, "audit-redact-field", "JSON field whose value is written as *** in the audit log, at any depth and case-insensitive. Repeatable.")
+	auditLogFile := flag.String("audit-log-file", "", "File receiving one JSON line per request to an --audit-path: time, request ID, client, method, URI and body.")
+	auditMaxBody := flag.Int("audit-max-body", 64<<10, "Bytes of each audited request body kept in the audit log; the rest is still forwarded but not recorded.")
+	var redactHeaders stringList
+	flag.Var(&redactHeaders, "redact-header", "Header whose value is logged as *** by --log-headers, in addition to Authorization, Proxy-Authorization, Cookie, Set-Cookie and X-Api-Key. Repeatable.")
+	clientCA := flag.String("client-ca", "", "CA bundle for verifying client certificates on the HTTPS listener (mTLS): a file path, inline PEM, or env:VARIABLE. Certificates are requested but optional unless --require-client-cert is set.")
+	requireClientCert := flag.Bool("require-client-cert", false, "Reject HTTPS handshakes without a client certificate signed by --client-ca.")
+	forwardClientCert := flag.Bool("forward-client-cert", false, "Send the verified client certificate's subject, issuer and serial upstream as X-Client-Cert-Subject, X-Client-Cert-Issuer and X-Client-Cert-Serial. Client-supplied copies are stripped.")
+	forwardClientCertPEM := flag.Bool("forward-client-cert-pem", false, "With --forward-client-cert, also send the URL-encoded PEM certificate as X-Client-Cert.")
+	accessLogFormat := flag.String("access-log-format", "", "Write one access log line per request to stdout: \"combined\", \"common\", or a template of nginx-style variables such as $remote_addr, $request, $status, $body_bytes_sent, $bytes_received, $request_time, $upstream_addr, $variant and $http_user_agent.")
+	accessLogFile := flag.String("access-log-file", "", "Also write one JSON object per request to this file (appended), e.g. for a log shipper. Independent of --access-log-format, which keeps writing text to stdout.")
+	statsInterval := flag.Duration("stats-interval", 0, "Log a summary every interval (e.g. 1m): requests, 5xx error rate and p50/p95 latency for that window. 0 disables it.")
+	injectHTML := flag.String("inject-html", "", "HTML fragment inserted before </body> of text/html responses: inline HTML, env:VARIABLE, or a file path. gzip responses are decoded first.")
+	injectHTMLTypes := flag.String("inject-html-types", "text/html", "Comma-separated response media types --inject-html applies to, e.g. text/html,application/xhtml+xml. Other responses stream untouched.")
+	responseFilterCmd := flag.String("response-filter-cmd", "", "Command (split on spaces, no shell) that receives each matching response body on stdin and writes the replacement to stdout. One process per response.")
+	responseFilterTypes := flag.String("response-filter-types", "", "Comma-separated response media types --response-filter-cmd applies to, e.g. text/html,application/json. Empty filters every response.")
+	responseFilterOnError := flag.String("response-filter-on-error", "passthrough", "What to do when --response-filter-cmd cannot be started: 'passthrough' sends the upstream body unchanged, 'error' answers 502.")
+	injectRecompress := flag.Bool("inject-html-recompress", false, "Gzip HTML again after --inject-html when the upstream sent gzip and the client accepts it. Costs CPU per response; default serves it uncompressed.")
+	maxURILength := flag.Int("max-uri-length", 8192, "Reject requests whose URI (path and query) is longer than this many bytes with 414. 0 disables the limit.")
+	maxHeaderCount := flag.Int("max-header-count", 100, "Reject requests with more header lines than this with 431, alongside the 1 MiB header size limit of net/http. 0 disables the limit.")
+	var listenMappings stringList
+	flag.Var(&listenMappings, "listen", "Extra plain HTTP listener with its own backend, as PORT=URL or HOST:PORT=URL, e.g. 8081=http://10.0.0.2:9000. Repeatable; all other settings are shared.")
+	listenFilePath := flag.String("listen-file", "", "File of extra plain HTTP listeners, one --listen style PORT=URL per line (# comments allowed). Re-read on SIGHUP: added, removed and retargeted lines take effect without disturbing the other listeners.")
+	var tlsCerts, tlsKeys stringList
+	flag.Var(&tlsCerts, "tls-cert", "Static TLS certificate instead of Let's Encrypt: a file path (default), inline PEM, or env:VARIABLE. Repeat with --tls-key for SNI-selected certificates.")
+	flag.Var(&tlsKeys, "tls-key", "Private key for the --tls-cert at the same position: a file path (default), inline PEM, or env:VARIABLE.")
+	certReloadDrain := flag.Duration("cert-reload-drain", 0, "After a SIGHUP certificate reload, close idle HTTPS keep-alive connections and close busy ones after their current response for this long (e.g. 30s), forcing new handshakes. For key compromise; 0 keeps existing connections.")
+	tlsHandshakeTimeout := flag.Duration("tls-handshake-timeout", 10*time.Second, "Drop HTTPS connections that have not completed the TLS handshake within this time. 0 disables the limit.")
+	ticketRotation := flag.Duration("ticket-rotation-interval", 0, "Rotate TLS session ticket keys at this interval (e.g. 1h). 0 keeps Go's built-in daily rotation.")
+	badGatewayPage := flag.String("bad-gateway-page", "", "HTML template served when the upstream is unreachable (503) or fails (502). Fields: .Status .StatusText .Message .RetryAfter")
+	retryAfter := flag.Int("retry-after", 0, "Seconds sent in Retry-After on proxy-generated 502/503/429 responses. 0 omits the header.")
+	maxConnsPerIP := flag.Int("max-conns-per-ip", 0, "Maximum concurrent TCP connections per client IP. 0 disables the limit.")
+	upstreamTimeout := flag.Duration("upstream-timeout", 0, "Maximum time for the whole upstream exchange including the body (e.g. 30s). 0 disables it; timeouts answer 504.")
+	failureThreshold := flag.Int("backend-failure-threshold", 3, "Consecutive failed exchanges (refused, reset or timed out) after which a backend is reported unhealthy; its next answered request reports it healthy again. 0 disables the events.")
+	eventWebhookURL := flag.String("event-webhook-url", "", "URL receiving a JSON POST for every backend state change (backend, old_state, new_state, time, reason). Failed deliveries are retried with backoff.")
+	idempotencyTTL := flag.Duration("idempotency-ttl", 0, "Keep the response to each POST or PATCH carrying --idempotency-header for this long (e.g. 24h) and replay it to repeats instead of forwarding them; concurrent repeats wait for the first. 0 disables it.")
+	idempotencyHeader := flag.String("idempotency-header", "Idempotency-Key", "Request header whose value identifies repeats of one request for --idempotency-ttl.")
+	idempotencyMaxBody := flag.Int("idempotency-max-body", 1<<20, "Largest response body kept for --idempotency-ttl replays; larger responses are passed on but not deduplicated.")
+	idempotencyMaxEntries := flag.Int("idempotency-max-entries", 10000, "Maximum responses kept for --idempotency-ttl at once; beyond it new keys are forwarded without deduplication.")
+	cacheSize := flag.Int("cache-size", 0, "Memory in bytes for caching upstream GET responses (e.g. 268435456). Fresh entries are served directly and stale ones revalidated with If-None-Match/If-Modified-Since, following Cache-Control, Expires and Vary. 0 disables the cache.")
+	cacheMaxObject := flag.Int("cache-max-object", 16<<20, "Largest response body kept by --cache-size; larger responses are passed on but not cached.")
+	upstreamTTFBTimeout := flag.Duration("upstream-ttfb-timeout", 0, "Maximum wait for the upstream response headers once the request has been sent (e.g. 5s), answering 504. Body download time is not limited. Not applied to --upstream-h2c backends. 0 disables it.")
+	var backendTimeoutValues stringList
+	flag.Var(&backendTimeoutValues, "backend-timeout", "Override --upstream-timeout for one backend, as URL=DURATION or HOST:PORT=DURATION, e.g. http://10.0.0.3:9000=2m. Matches --target-url, --canary-target, --default-target, --hash-backend and --listen backends; 0 disables the timeout. Repeatable.")
+	deadlineHeader := flag.String("propagate-deadline-header", "", "Header carrying the request deadline to the backend, e.g. Grpc-Timeout or X-Request-Deadline. Requires --upstream-timeout.")
+	deadlineFormat := flag.String("propagate-deadline-format", "ms", "Deadline header format: 'grpc' (e.g. 1500m), 'ms' (remaining milliseconds), or 'unix-ms' (absolute deadline).")
+	proxyName := flag.String("proxy-name", "chicha-http-proxy", "Name this proxy announces in the Via header.")
+	addVia := flag.Bool("via", true, "Append a Via header to forwarded requests. Disable to keep the proxy invisible to backends.")
+	addForwardedServer := flag.Bool("forwarded-server", false, "Set X-Forwarded-Server to this machine's hostname on forwarded requests.")
+	requestIDHeader := flag.String("request-id-header", "X-Request-Id", "Header carrying the request ID to the backend and back to the client. An incoming value is reused; otherwise one is generated. Empty keeps the ID in logs only.")
+	enableFaults := flag.Bool("enable-fault-injection", false, "Allow the --fault-* flags. Required so chaos testing can never be switched on by a stray flag alone.")
+	faultDelay := flag.Duration("fault-delay", 0, "Delay added before forwarding --fault-delay-percent of requests. Needs --enable-fault-injection.")
+	faultDelayPercent := flag.Int("fault-delay-percent", 0, "Percentage (0-100) of requests delayed by --fault-delay.")
+	faultAbortStatus := flag.Int("fault-abort-status", http.StatusServiceUnavailable, "Status returned instead of forwarding for --fault-abort-percent of requests.")
+	faultAbortPercent := flag.Int("fault-abort-percent", 0, "Percentage (0-100) of requests answered with --fault-abort-status without reaching the backend. Needs --enable-fault-injection.")
+	errorFormat := flag.String("error-format", "text", "Body format of errors generated by the proxy itself: text or json ({\"error\":\"bad_gateway\",\"message\":...,\"request_id\":...}).")
+	allowedHosts := flag.String("allowed-hosts", "", "Comma-separated hostnames clients may request, e.g. example.com,*.example.com. Other Host headers get 400. Empty allows any host.")
+	waitForTarget := flag.Duration("wait-for-target", 0, "At startup, wait up to this long (e.g. 60s) for the --target-url hostname to resolve before opening any listener; exit if it never does. 0 starts immediately.")
+	decompressRequest := flag.Bool("decompress-request", false, "Decode gzip and deflate request bodies before forwarding, for backends that cannot; malformed bodies get 400.")
+	maxDecompressedBody := flag.Int64("max-decompressed-body", 64<<20, "Largest request body --decompress-request will expand to; larger ones get 413 so small compressed uploads cannot exhaust memory.")
+	retries := flag.Int("upstream-retries", 0, "Retries after a transport failure: any method when the connection could not be opened, idempotent methods otherwise. 0 disables retries.")
+	retryBase := flag.Duration("retry-backoff-base", 100*time.Millisecond, "Delay before the first retry; doubles for each further retry up to --retry-backoff-max.")
+	retryMax := flag.Duration("retry-backoff-max", 2*time.Second, "Upper bound of the retry delay before jitter.")
+	retryJitter := flag.String("retry-jitter", "full", "Randomisation of retry delays: full (0 to delay), equal (half to delay) or none.")
+	serverTiming := flag.Bool("server-timing", false, "Add a Server-Timing header with proxy overhead, DNS, connect, TLS and upstream time, shown by browser devtools. Reveals internal latency, so enable for debugging.")
+	followRedirects := flag.Bool("follow-redirects", true, "Follow upstream redirects inside the proxy and answer with the final response. Disable to pass 3xx responses to the client.")
+	maxRedirects := flag.Int("max-redirects", 10, "Upstream redirects followed per request before answering 502. All hops share one --upstream-timeout deadline.")
+	redirectTimeout := flag.Duration("redirect-timeout", 30*time.Second, "Maximum time from the first upstream request until a followed redirect chain's final response headers arrive; later answers 504. The final body is not limited by it.")
+	methodOverrideHeader := flag.String("method-override-header", "", "Header (e.g. X-HTTP-Method-Override) through which POST requests ask for PUT, PATCH or DELETE; a _method query parameter works too. Empty disables overrides.")
+	forwardHeadersOnly := flag.Bool("forward-headers-only", false, "Guarantee flat memory for any body size: request and response bodies are streamed, never buffered. Redirects answering a request with a body are passed to the client, and body-rewriting features are refused.")
+	bufferResponses := flag.Bool("buffer-responses", false, "Read each upstream body fully into memory before replying. Frees backends from slow clients at the cost of memory per request and time-to-first-byte; default streams.")
+	logTLS := flag.Bool("log-tls", false, "Log the negotiated TLS version, cipher suite and SNI for every HTTPS request.")
+	logLatency := flag.Bool("log-latency", false, "Log upstream time-to-first-byte and total request time for every request.")
+	upstreamProxy := flag.String("upstream-proxy", "", "Reach backends through this proxy: http://host:port, https://host:port, socks5://host:port or socks5h://host:port (either way the proxy resolves backend names). Credentials go in the URL. Empty connects directly.")
+	upstreamNoProxy := flag.String("upstream-no-proxy", "", "Comma-separated backends reached directly despite --upstream-proxy, in NO_PROXY syntax: hosts, .domain suffixes, IPs, CIDRs, optional :port. Empty uses the NO_PROXY environment variable.")
+	upstreamSourceIP := flag.String("upstream-source-ip", "", "Local IP address upstream connections originate from, for backends that filter by source address. Must be assigned to a local interface.")
+	upstreamKeepAlive := flag.Duration("upstream-keepalive-interval", 15*time.Second, "TCP keepalive probe interval on upstream connections; a backend that stops answering 3 probes is dropped from the pool. Negative disables probes.")
+	maxDialConcurrency := flag.Int("max-dial-concurrency", 0, "Maximum new upstream connections being established at once; further requests needing a connection wait, bounded by --upstream-timeout. Pooled connections are reused freely. 0 means no limit.")
+	upstreamMaxConnLifetime := flag.Duration("upstream-max-conn-lifetime", 0, "Retire pooled upstream connections older than this (e.g. 5m) before their next request. 0 keeps them indefinitely.")
+	shutdownOrder := flag.String("shutdown-order", "parallel", "Graceful shutdown order on SIGTERM: 'parallel', 'http-first' or 'https-first'. The admin listener always stops last.")
+	shutdownDrainDelay := flag.Duration("shutdown-drain-delay", 5*time.Second, "Pause between shutdown stages so load balancers notice the first listener is gone.")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "Maximum time each listener waits for in-flight requests during shutdown.")
+	adminBind := flag.String("admin-bind", "", "Address for the admin listener serving /healthz, /admin/stats and /debug/pprof/, e.g. 127.0.0.1:9090. Empty disables it.")
+	adminAllow := flag.String("admin-allow", "", "Comma-separated IPs or CIDRs allowed to reach the admin listener. Empty allows every client that can reach --admin-bind.")
+	softTimeout := flag.Duration("soft-timeout", 0, "After this long (e.g. 2s) stop reading streamed upstream bodies of unknown length and finish the response with an X-Proxy-Truncated trailer. 0 disables it.")
+	allowBackendOverride := flag.Bool("allow-backend-override", false, "Let clients from --trusted-proxies route a request to any backend with an X-Proxy-Backend: https://host:port header. For debugging only.")
+	trustedProxies := flag.String("trusted-proxies", "", "Comma-separated IPs or CIDRs trusted to send proxy control headers such as X-Proxy-Backend.")
+	tcpNoDelay := flag.Bool("tcp-nodelay", true, "Send small writes on client connections immediately (TCP_NODELAY, Go's default). Disable to let Nagle's algorithm batch them for throughput.")
+	tcpReadBuffer := flag.Int("tcp-read-buffer", 0, "Socket receive buffer in bytes for client connections (SO_RCVBUF). 0 keeps the kernel's autotuning.")
+	tcpWriteBuffer := flag.Int("tcp-write-buffer", 0, "Socket send buffer in bytes for client connections (SO_SNDBUF). 0 keeps the kernel's autotuning.")
+	acceptBackoff := flag.Duration("accept-backoff", 5*time.Millisecond, "Initial delay before retrying after a transient accept error (EMFILE, ECONNABORTED); doubles up to 1s. 0 leaves retries to net/http.")
+	network := flag.String("network", "tcp", "Address family for the HTTP and HTTPS listeners: 'tcp' (IPv4 and IPv6), 'tcp4' or 'tcp6'.")
+	pidFile := flag.String("pid-file", "", "Write the process ID to this file at startup and remove it on exit. Startup fails if it names a running process.")
+	forcePIDFile := flag.Bool("force", false, "Take over --pid-file even if it names a running process.")
+	syslogAddr := flag.String("syslog-addr", "", "Also send the diagnostic and access logs to syslog: udp://host:514, tcp://host:514, unix:///dev/log, or host:port for UDP. The connection is re-established if the endpoint drops.")
+	syslogFacility := flag.String("syslog-facility", "daemon", "Syslog facility for --syslog-addr: daemon, user, local0 to local7, and the other RFC 5424 names.")
+	syslogTag := flag.String("syslog-tag", "chicha-http-proxy", "Syslog tag (program name) for --syslog-addr messages.")
+	syslogOnly := flag.Bool("syslog-only", false, "With --syslog-addr, stop writing the logs to stdout as well.")
+	enableH2C := flag.Bool("enable-h2c", false, "Accept cleartext HTTP/2 (h2c, prior knowledge or Upgrade) on the plain HTTP listeners, e.g. for gRPC clients inside a service mesh.")
+	upstreamH2C := flag.Bool("upstream-h2c", false, "Speak cleartext HTTP/2 with prior knowledge to http:// backends, e.g. gRPC servers. https:// backends keep the regular transport; --upstream-max-conn-lifetime does not apply.")
+	quiet := flag.Bool("quiet", false, "Do not print the startup banner summarising listeners, targets, TLS mode and the options in effect.")
+	showVersion := flag.Bool("version", false, "Show program version")
+
+	// Send log output to STDOUT so systemd captures it consistently.
+	log.SetOutput(os.Stdout)
+
+	// Parse the flags
+	flag.Parse()
+
+	// If --version is specified, print the program version and exit
+	if *showVersion {
+		fmt.Printf("Program version: %s\n", version)
+		os.Exit(0)
+	}
+
+	// Set up syslog first so that configuration errors reported below reach it too.
+	if *syslogAddr != "" {
+		writer, err := newSyslogWriter(*syslogAddr, *syslogFacility, *syslogTag)
+		if err != nil {
+			exitWithError("Invalid syslog-addr value", err)
+		}
+		diagnostic := io.Writer(syslogStream{w: writer, diagnostic: true})
+		access := io.Writer(syslogStream{w: writer})
+		if !*syslogOnly {
+			diagnostic = io.MultiWriter(os.Stdout, diagnostic)
+			access = io.MultiWriter(os.Stdout, access)
+		}
+		log.SetOutput(diagnostic)
+		accessLogger.SetOutput(access)
+		flushLogs = func() { writer.flush(syslogWriteTimeout) }
+	} else if *syslogOnly {
+		exitWithError("Invalid syslog-only value", fmt.Errorf("--syslog-only needs --syslog-addr"))
+	}
+
+	// The target URL must be specified.
+	if *targetURL == "" {
+		log.Fatal("Target URL (--target-url) is not specified")
+	}
+
+	// Static certificates replace Let's Encrypt entirely, so both halves of the pair are required.
+	useStaticTLS := len(tlsCerts) > 0 || len(tlsKeys) > 0
+	if len(tlsCerts) != len(tlsKeys) {
+		exitWithError("Invalid TLS configuration", fmt.Errorf("got %d --tls-cert and %d --tls-key values, they must be given in pairs", len(tlsCerts), len(tlsKeys)))
+	}
+
+	// If a domain is provided for certificate retrieval:
+	// - Force HTTP port to 80 (required for Let's Encrypt HTTP challenge).
+	// - Allow user to specify HTTPS port (default 443), if desired.
+	if *domain != "" && !useStaticTLS {
+		*httpPort = "80"
+		log.Printf("Domain specified. HTTP port forced to 80. HTTPS port: %s", *httpsPort)
+	} else if useStaticTLS {
+		// Static certificates need no ACME challenge, so the HTTP port stays user-defined.
+		log.Printf("Static TLS certificate configured. HTTP port: %s. HTTPS port: %s", *httpPort, *httpsPort)
+	} else {
+		// If no domain is specified:
+		// - The user can use any HTTP port they like.
+		// - No HTTPS will be started as no certificate is requested.
+		fmt.Printf("No domain specified. Running HTTP on port %s only.\n", *httpPort)
+	}
+
+	parsedTarget, err := url.Parse(*targetURL)
+	if err != nil {
+		exitWithError("Failed to parse target URL", err)
+	}
+
+	switch *network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		exitWithError("Invalid network value", fmt.Errorf("%s", *network))
+	}
+
+	switch *shutdownOrder {
+	case "parallel", "http-first", "https-first":
+	default:
+		exitWithError("Invalid shutdown-order value", fmt.Errorf("%s", *shutdownOrder))
+	}
+
+	switch *canonicalHost {
+	case "", "apex", "www":
+	default:
+		exitWithError("Invalid canonical-host value", fmt.Errorf("%s (expected apex or www)", *canonicalHost))
+	}
+
+	// Credentials in the target URL become an Authorization header; keeping them out of the URL also keeps them out of logs.
+	upstreamUser := parsedTarget.User
+	parsedTarget.User = nil
+
+	// Forcing the scheme decouples edge TLS from backend TLS without rewriting --target-url.
+	switch *upstreamScheme {
+	case "":
+	case "http", "https":
+		parsedTarget.Scheme = *upstreamScheme
+	default:
+		exitWithError("Invalid upstream-scheme value", fmt.Errorf("%s (expected http or https)", *upstreamScheme))
+	}
+
+	// The canary gets the same credential handling and scheme override as the main target so variants differ only in backend.
+	var canaryURL, canaryHost string
+	var canaryUser *url.Userinfo
+	if *canaryTarget != "" {
+		parsedCanary, err := url.Parse(*canaryTarget)
+		if err != nil || parsedCanary.Host == "" {
+			exitWithError("Invalid canary-target value", fmt.Errorf("%s", *canaryTarget))
+		}
+		canaryUser = parsedCanary.User
+		parsedCanary.User = nil
+		if *upstreamScheme != "" {
+			parsedCanary.Scheme = *upstreamScheme
+		}
+		canaryURL, canaryHost = strings.TrimSuffix(parsedCanary.String(), "/"), parsedCanary.Host
+	}
+
+	// So does the default target.
+	var defaultURL, defaultHost string
+	var defaultUser *url.Userinfo
+	if *defaultTarget != "" {
+		parsedDefault, err := url.Parse(*defaultTarget)
+		if err != nil || parsedDefault.Host == "" {
+			exitWithError("Invalid default-target value", fmt.Errorf("%s", *defaultTarget))
+		}
+		if *stripPathPrefix == "" {
+			exitWithError("Invalid default-target value", fmt.Errorf("--default-target needs --strip-path-prefix to decide which paths it receives"))
+		}
+		defaultUser = parsedDefault.User
+		parsedDefault.User = nil
+		if *upstreamScheme != "" {
+			parsedDefault.Scheme = *upstreamScheme
+		}
+		defaultURL, defaultHost = strings.TrimSuffix(parsedDefault.String(), "/"), parsedDefault.Host
+	}
+	if *noRouteStatus < 400 || *noRouteStatus > 599 {
+		exitWithError("Invalid no-route-status value", fmt.Errorf("%d (expected a 4xx or 5xx status)", *noRouteStatus))
+	}
+
+	// Hash backends share the credential handling and scheme override of --target-url as well.
+	var ring *hashRing
+	var hashBackends []hashBackend
+	if len(hashBackendValues) > 0 || *hashHeader != "" {
+		if len(hashBackendValues) == 0 || strings.TrimSpace(*hashHeader) == "" {
+			exitWithError("Invalid hash configuration", fmt.Errorf("--hash-header and --hash-backend must be given together"))
+		}
+		for _, value := range hashBackendValues {
+			backend, err := parseHashBackend(value, *upstreamScheme)
+			if err != nil {
+				exitWithError("Invalid hash-backend value", err)
+			}
+			hashBackends = append(hashBackends, backend)
+		}
+		ring = newHashRing(hashBackends)
+	}
+	var clientCAs *x509.CertPool
+	if *clientCA != "" {
+		caPEM, err := readPEM(*clientCA)
+		if err != nil {
+			exitWithError("Failed to read client CA", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caPEM) {
+			exitWithError("Invalid client CA", fmt.Errorf("no PEM certificates found in %s", *clientCA))
+		}
+	} else if *requireClientCert {
+		exitWithError("Invalid TLS configuration", fmt.Errorf("--require-client-cert needs --client-ca"))
+	}
+	if *forwardClientCertPEM && !*forwardClientCert {
+		exitWithError("Invalid TLS configuration", fmt.Errorf("--forward-client-cert-pem needs --forward-client-cert"))
+	}
+
+	if preset, ok := accessLogFormats[*accessLogFormat]; ok {
+		*accessLogFormat = preset
+	}
+	if err := validateAccessLogFormat(*accessLogFormat); err != nil {
+		exitWithError("Invalid access-log-format value", err)
+	}
+
+	// The JSON file is a second sink next to stdout, so the console stays readable while aggregation gets structured records.
+	var accessLogJSON *log.Logger
+	if *accessLogFile != "" {
+		file, err := os.OpenFile(*accessLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			exitWithError("Failed to open access log file", err)
+		}
+		accessLogJSON = log.New(file, "", 0)
+		go reopenAccessLogOnSignal(accessLogJSON, *accessLogFile, file)
+	}
+
+	if *forwardHeadersOnly && (*bufferResponses || *injectHTML != "" || *decompressRequest) {
+		exitWithError("Invalid forward-headers-only value", fmt.Errorf("--buffer-responses, --inject-html and --decompress-request read whole bodies into memory"))
+	}
+	if *maxDecompressedBody <= 0 {
+		exitWithError("Invalid max-decompressed-body value", fmt.Errorf("%d", *maxDecompressedBody))
+	}
+
+	// The audit file is opened once, append-only and private to the proxy user, since bodies may contain personal data.
+	var auditLog *log.Logger
+	if len(auditPaths) > 0 || *auditLogFile != "" {
+		if len(auditPaths) == 0 || *auditLogFile == "" {
+			exitWithError("Invalid audit configuration", fmt.Errorf("--audit-path and --audit-log-file must be given together"))
+		}
+		if *auditMaxBody <= 0 {
+			exitWithError("Invalid audit-max-body value", fmt.Errorf("%d", *auditMaxBody))
+		}
+		auditFile, err := os.OpenFile(*auditLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			exitWithError("Failed to open audit log file", err)
+		}
+		auditLog = log.New(auditFile, "", 0)
+	}
+	for i, prefix := range auditPaths {
+		auditPaths[i] = path.Clean("/" + prefix)
+	}
+	auditRedact := make(map[string]bool)
+	for _, field := range auditRedactFields {
+		auditRedact[strings.ToLower(strings.TrimSpace(field))] = true
+	}
+
+	if *faultDelayPercent < 0 || *faultDelayPercent > 100 {
+		exitWithError("Invalid fault-delay-percent value", fmt.Errorf("%d", *faultDelayPercent))
+	}
+	if *faultAbortPercent < 0 || *faultAbortPercent > 100 {
+		exitWithError("Invalid fault-abort-percent value", fmt.Errorf("%d", *faultAbortPercent))
+	}
+	if *faultAbortStatus < 400 || *faultAbortStatus > 599 {
+		exitWithError("Invalid fault-abort-status value", fmt.Errorf("%d", *faultAbortStatus))
+	}
+	if *faultDelay < 0 || (*faultDelayPercent > 0 && *faultDelay == 0) {
+		exitWithError("Invalid fault-delay value", fmt.Errorf("%s", *faultDelay))
+	}
+	faultsRequested := *faultDelayPercent > 0 || *faultAbortPercent > 0
+	if faultsRequested && !*enableFaults {
+		exitWithError("Invalid fault injection configuration", fmt.Errorf("--fault-delay-percent and --fault-abort-percent need --enable-fault-injection"))
+	}
+	if faultsRequested {
+		log.Printf("WARNING: fault injection enabled: delaying %d%% of requests by %s, failing %d%% with %d", *faultDelayPercent, *faultDelay, *faultAbortPercent, *faultAbortStatus)
+	}
+
+	switch *errorFormat {
+	case "text":
+	case "json":
+		if *badGatewayPage != "" {
+			exitWithError("Invalid error-format value", fmt.Errorf("--bad-gateway-page renders HTML and cannot be combined with json"))
+		}
+	default:
+		exitWithError("Invalid error-format value", fmt.Errorf("%s", *errorFormat))
+	}
+
+	var hostAllowlist []string
+	for _, host := range strings.Split(*allowedHosts, ",") {
+		host = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+		if host == "" {
+			continue
+		}
+		if strings.Contains(host, "*") && (!strings.HasPrefix(host, "*.") || strings.Count(host, "*") > 1) {
+			exitWithError("Invalid allowed-hosts value", fmt.Errorf("%s: wildcards must look like *.example.com", host))
+		}
+		hostAllowlist = append(hostAllowlist, host)
+	}
+
+	if *retries < 0 {
+		exitWithError("Invalid upstream-retries value", fmt.Errorf("%d", *retries))
+	}
+	if *retryBase <= 0 || *retryMax < *retryBase {
+		exitWithError("Invalid retry backoff", fmt.Errorf("--retry-backoff-base %s must be positive and not above --retry-backoff-max %s", *retryBase, *retryMax))
+	}
+	switch *retryJitter {
+	case "full", "equal", "none":
+	default:
+		exitWithError("Invalid retry-jitter value", fmt.Errorf("%s", *retryJitter))
+	}
+
+	if *maxRedirects < 0 {
+		exitWithError("Invalid max-redirects value", fmt.Errorf("%d", *maxRedirects))
+	}
+	if *redirectTimeout <= 0 && *followRedirects && *maxRedirects > 0 {
+		exitWithError("Invalid redirect-timeout value", fmt.Errorf("%s (following redirects needs a positive deadline; use --follow-redirects=false to pass them to the client)", *redirectTimeout))
+	}
+	if !*followRedirects {
+		*maxRedirects = 0
+	}
+
+	// Transforms run in the order registered here; each sees the body as left by the previous one.
+	var transforms []responseTransform
+	if *injectHTML != "" {
+		fragment, err := readFragment(*injectHTML)
+		if err != nil {
+			exitWithError("Failed to read inject-html fragment", err)
+		}
+		types, err := parseMediaTypes(*injectHTMLTypes)
+		if err != nil || len(types) == 0 {
+			exitWithError("Invalid inject-html-types value", fmt.Errorf("%s", *injectHTMLTypes))
+		}
+		recompress := *injectRecompress
+		transforms = append(transforms, responseTransform{
+			name:       "inject-html",
+			mediaTypes: types,
+			apply: func(resp *http.Response, r *http.Request) error {
+				return injectHTMLFragment(resp, fragment, recompress, acceptsGzip(r))
+			},
+		})
+	}
+	if *responseFilterCmd != "" {
+		command := strings.Fields(*responseFilterCmd)
+		types, err := parseMediaTypes(*responseFilterTypes)
+		if err != nil {
+			exitWithError("Invalid response-filter-types value", fmt.Errorf("%s", *responseFilterTypes))
+		}
+		var passthrough bool
+		switch *responseFilterOnError {
+		case "passthrough":
+			passthrough = true
+		case "error":
+		default:
+			exitWithError("Invalid response-filter-on-error value", fmt.Errorf("%s", *responseFilterOnError))
+		}
+		if _, err := exec.LookPath(command[0]); err != nil {
+			exitWithError("Invalid response-filter-cmd value", err)
+		}
+		transforms = append(transforms, responseTransform{
+			name:       "response-filter-cmd",
+			mediaTypes: types,
+			apply: func(resp *http.Response, r *http.Request) error {
+				return filterResponseBody(resp, r, command, passthrough)
+			},
+		})
+	}
+	if *maxURILength < 0 {
+		exitWithError("Invalid max-uri-length value", fmt.Errorf("%d", *maxURILength))
+	}
+	if *maxHeaderCount < 0 {
+		exitWithError("Invalid max-header-count value", fmt.Errorf("%d", *maxHeaderCount))
+	}
+	if *canaryPercent < 0 || *canaryPercent > 100 {
+		exitWithError("Invalid canary-percent value", fmt.Errorf("%d (expected 0-100)", *canaryPercent))
+	}
+
+	hostMode := hostFromDomain
+	switch *hostModeFlag {
+	case "domain":
+		hostMode = hostFromDomain
+	case "target":
+		hostMode = hostFromTarget
+	default:
+		exitWithError("Invalid host-mode value", fmt.Errorf("%s", *hostModeFlag))
+	}
+
+	rejectPrefixMiss := false
+	switch *prefixMiss {
+	case "pass":
+		rejectPrefixMiss = false
+	case "reject":
+		rejectPrefixMiss = true
+	default:
+		exitWithError("Invalid strip-prefix-miss value", fmt.Errorf("%s", *prefixMiss))
+	}
+
+	trailingSlashPolicy := ""
+	switch *trailingSlash {
+	case "preserve":
+	case "add", "remove":
+		trailingSlashPolicy = *trailingSlash
+	default:
+		exitWithError("Invalid trailing-slash value", fmt.Errorf("%s", *trailingSlash))
+	}
+	trailingSlashRewrite := false
+	switch *trailingSlashMode {
+	case "redirect":
+	case "rewrite":
+		trailingSlashRewrite = true
+	default:
+		exitWithError("Invalid trailing-slash-mode value", fmt.Errorf("%s", *trailingSlashMode))
+	}
+	normalizeRouteOnly := false
+	switch *normalizePathMode {
+	case "forward":
+	case "route":
+		normalizeRouteOnly = *normalizePath
+		// The client's path may not start with the prefix its normalised form matched, so there would be nothing to strip.
+		if *normalizePath && (*stripPathPrefix != "" || trailingSlashRewrite) {
+			exitWithError("Invalid normalize-path-mode value", fmt.Errorf("'route' cannot be combined with --strip-path-prefix or --trailing-slash-mode=rewrite"))
+		}
+	default:
+		exitWithError("Invalid normalize-path-mode value", fmt.Errorf("%s", *normalizePathMode))
+	}
+
+	statusRemap, err := parseStatusRemap(*remapStatus)
+	if err != nil {
+		exitWithError("Invalid remap-status value", err)
+	}
+
+	redacted := make(map[string]bool)
+	for _, name := range append(defaultRedactedHeaders, redactHeaders...) {
+		redacted[http.CanonicalHeaderKey(strings.TrimSpace(name))] = true
+	}
+
+	stripped := make(map[string]bool)
+	for _, name := range stripResponseHeaders {
+		stripped[http.CanonicalHeaderKey(strings.TrimSpace(name))] = true
+	}
+	var allowed map[string]bool
+	if len(allowResponseHeaders) > 0 {
+		allowed = make(map[string]bool)
+		for _, name := range append(framingHeaders, allowResponseHeaders...) {
+			allowed[http.CanonicalHeaderKey(strings.TrimSpace(name))] = true
+		}
+	}
+
+	securityHeaders, err := buildSecurityHeaders(*securityPreset, securityHeaderOverrides)
+	if err != nil {
+		exitWithError("Invalid security-headers value", err)
+	}
+
+	statusBodies := make(map[int]statusBody)
+	for _, value := range statusBodyValues {
+		status, body, err := parseStatusBody(value)
+		if err != nil {
+			exitWithError("Invalid status-body value", err)
+		}
+		statusBodies[status] = body
+	}
+
+	// Locally answered OPTIONS carry exactly the configured headers; nothing from the backend is merged in.
+	var optionsHeaders http.Header
+	if *handleOptions {
+		optionsHeaders = http.Header{}
+		if allow := strings.TrimSpace(*optionsAllow); allow != "" {
+			optionsHeaders.Set("Allow", allow)
+		}
+		for _, value := range optionsHeaderValues {
+			name, headerValue, ok := strings.Cut(value, "=")
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if !ok || name == "" {
+				exitWithError("Invalid options-header value", fmt.Errorf("expected NAME=VALUE, got %q", value))
+			}
+			optionsHeaders.Add(name, strings.TrimSpace(headerValue))
+		}
+	} else if len(optionsHeaderValues) > 0 {
+		exitWithError("Invalid options-header value", fmt.Errorf("--options-header needs --handle-options-locally"))
+	}
+
+	var errorPage *template.Template
+	if *badGatewayPage != "" {
+		errorPage, err = template.ParseFiles(*badGatewayPage)
+		if err != nil {
+			exitWithError("Failed to load bad gateway page", err)
+		}
+	}
+
+	switch *deadlineFormat {
+	case "grpc", "ms", "unix-ms":
+	default:
+		exitWithError("Invalid propagate-deadline-format value", fmt.Errorf("%s", *deadlineFormat))
+	}
+
+	viaName := ""
+	if *addVia {
+		viaName = *proxyName
+	}
+	forwardedServer := ""
+	if *addForwardedServer {
+		forwardedServer, err = os.Hostname()
+		if err != nil {
+			exitWithError("Failed to get hostname for X-Forwarded-Server", err)
+		}
+	}
+
+	adminAllowed, err := parseCIDRs(*adminAllow)
+	if err != nil {
+		exitWithError("Invalid admin-allow value", err)
+	}
+	trustedNetworks, err := parseCIDRs(*trustedProxies)
+	if err != nil {
+		exitWithError("Invalid trusted-proxies value", err)
+	}
+	// An override open to everyone would turn the proxy into an open relay, so the allowlist is mandatory.
+	if *allowBackendOverride && len(trustedNetworks) == 0 {
+		exitWithError("Invalid allow-backend-override value", fmt.Errorf("--allow-backend-override requires --trusted-proxies"))
+	}
+	stats := newProxyStats()
+	var window *windowStats
+	if *statsInterval < 0 {
+		exitWithError("Invalid stats-interval value", fmt.Errorf("%s", *statsInterval))
+	} else if *statsInterval > 0 {
+		window = &windowStats{}
+		go window.logEvery(*statsInterval)
+	}
+
+	var health *backendHealth
+	if *failureThreshold < 0 {
+		exitWithError("Invalid backend-failure-threshold value", fmt.Errorf("%d", *failureThreshold))
+	} else if *failureThreshold > 0 {
+		var webhook *eventWebhook
+		if *eventWebhookURL != "" {
+			parsed, err := url.Parse(*eventWebhookURL)
+			if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+				exitWithError("Invalid event-webhook-url value", fmt.Errorf("expected an http or https URL"))
+			}
+			webhook = newEventWebhook(*eventWebhookURL)
+		}
+		health = newBackendHealth(*failureThreshold, webhook)
+	} else if *eventWebhookURL != "" {
+		exitWithError("Invalid event-webhook-url value", fmt.Errorf("--event-webhook-url needs a positive --backend-failure-threshold"))
+	}
+
+	var idempotency *idempotencyCache
+	if *idempotencyTTL < 0 {
+		exitWithError("Invalid idempotency-ttl value", fmt.Errorf("%s", *idempotencyTTL))
+	} else if *idempotencyTTL > 0 {
+		if strings.TrimSpace(*idempotencyHeader) == "" {
+			exitWithError("Invalid idempotency-header value", fmt.Errorf("a header name is required with --idempotency-ttl"))
+		}
+		// Telling a repeat from a reused key with another payload takes the whole body, which --forward-headers-only never holds.
+		if *forwardHeadersOnly {
+			exitWithError("Invalid idempotency-ttl value", fmt.Errorf("--idempotency-ttl compares request bodies and cannot be combined with --forward-headers-only"))
+		}
+		if *idempotencyMaxBody <= 0 || *idempotencyMaxEntries <= 0 {
+			exitWithError("Invalid idempotency limits", fmt.Errorf("--idempotency-max-body %d and --idempotency-max-entries %d must be positive", *idempotencyMaxBody, *idempotencyMaxEntries))
+		}
+		idempotency = newIdempotencyCache(*idempotencyTTL, *idempotencyMaxBody, *idempotencyMaxEntries)
+	}
+
+	if *upstreamTTFBTimeout < 0 {
+		exitWithError("Invalid upstream-ttfb-timeout value", fmt.Errorf("%s", *upstreamTTFBTimeout))
+	}
+	dialer := &upstreamDialer{maxLifetime: *upstreamMaxConnLifetime}
+	if *maxDialConcurrency < 0 {
+		exitWithError("Invalid max-dial-concurrency value", fmt.Errorf("%d", *maxDialConcurrency))
+	} else if *maxDialConcurrency > 0 {
+		dialer.slots = make(chan struct{}, *maxDialConcurrency)
+	}
+	// On multi-homed hosts backend ACLs often filter by source address, so upstream connections can be pinned to one.
+	if *upstreamSourceIP != "" {
+		sourceIP := net.ParseIP(*upstreamSourceIP)
+		if sourceIP == nil {
+			exitWithError("Invalid upstream-source-ip value", fmt.Errorf("%s", *upstreamSourceIP))
+		}
+		if err := requireLocalIP(sourceIP); err != nil {
+			exitWithError("Invalid upstream-source-ip value", err)
+		}
+		dialer.dialer.LocalAddr = &net.TCPAddr{IP: sourceIP}
+	}
+	// A partitioned backend never sends a FIN, so idle pooled connections look healthy until the kernel's keepalive
+	// (often hours) gives up. Probing at the interval and failing after three misses bounds that to about four intervals.
+	if *upstreamKeepAlive < 0 {
+		dialer.dialer.KeepAliveConfig = net.KeepAliveConfig{Enable: false}
+		dialer.dialer.KeepAlive = -1
+	} else if *upstreamKeepAlive > 0 {
+		dialer.dialer.KeepAliveConfig = net.KeepAliveConfig{Enable: true, Idle: *upstreamKeepAlive, Interval: *upstreamKeepAlive, Count: 3}
+	}
+	// Upstream connections speak HTTP/1.1: a custom DialContext and TLSClientConfig switch off Go's automatic HTTP/2,
+	// so a backend can never send push promises, and the handler never pushes to clients itself.
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		DialContext:     dialer.DialContext,
+		// Never negotiate gzip on the client's behalf: transparent decompression would strip Content-Length and
+		// hand out bytes that no longer match the upstream's ETag, Accept-Ranges and Content-Range offsets.
+		DisableCompression: true,
+		// The clock starts once the request is fully written, so slow uploads and long downloads are unaffected and only
+		// a backend that accepted the request and then stalled is abandoned.
+		ResponseHeaderTimeout: *upstreamTTFBTimeout,
+	}
+	// In egress-restricted networks backends are only reachable through a corporate proxy. The transport tunnels
+	// https:// backends with CONNECT and sends http:// requests to an HTTP proxy directly; SOCKS proxies carry both.
+	// Connections to the proxy itself still go through the dialer, so source IP, keepalive and dial limits apply to them.
+	if *upstreamProxy != "" {
+		proxyURL, err := url.Parse(*upstreamProxy)
+		if err != nil || proxyURL.Host == "" {
+			exitWithError("Invalid upstream-proxy value", fmt.Errorf("expected a URL such as http://proxy.example.com:3128"))
+		}
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			exitWithError("Invalid upstream-proxy value", fmt.Errorf("unsupported scheme %q (expected http, https, socks5 or socks5h)", proxyURL.Scheme))
+		}
+		if *upstreamH2C {
+			exitWithError("Invalid upstream-proxy value", fmt.Errorf("--upstream-h2c connects to backends directly and cannot be combined with --upstream-proxy"))
+		}
+		noProxy := *upstreamNoProxy
+		if noProxy == "" {
+			noProxy = httpproxy.FromEnvironment().NoProxy
+		}
+		// httpproxy only decides which backends bypass the proxy: it applies the NO_PROXY matching rules, which also
+		// keep localhost and loopback backends direct, but rejects socks5h:// URLs. It therefore gets a stand-in
+		// address and the transport receives the URL parsed above, whose scheme net/http dials itself.
+		bypass := "http://" + proxyURL.Host
+		proxyFunc := (&httpproxy.Config{HTTPProxy: bypass, HTTPSProxy: bypass, NoProxy: noProxy}).ProxyFunc()
+		transport.Proxy = func(req *http.Request) (*url.URL, error) {
+			if via, err := proxyFunc(req.URL); via == nil || err != nil {
+				return nil, err
+			}
+			return proxyURL, nil
+		}
+	} else if *upstreamNoProxy != "" {
+		exitWithError("Invalid upstream-no-proxy value", fmt.Errorf("--upstream-no-proxy needs --upstream-proxy"))
+	}
+	var roundTripper http.RoundTripper = transport
+	if *upstreamH2C {
+		roundTripper = h2cRoundTripper{h2c: newH2CTransport(dialer), fallback: transport}
+	}
+	// The cache sits below the redirect loop and the transforms, so it stores what the backends sent and every hop
+	// and rewrite works on cached responses exactly as on fetched ones.
+	if *cacheSize < 0 || *cacheMaxObject <= 0 {
+		exitWithError("Invalid cache limits", fmt.Errorf("--cache-size %d must not be negative and --cache-max-object %d must be positive", *cacheSize, *cacheMaxObject))
+	} else if *cacheSize > 0 {
+		if *forwardHeadersOnly {
+			exitWithError("Invalid cache-size value", fmt.Errorf("--cache-size keeps response bodies in memory and cannot be combined with --forward-headers-only"))
+		}
+		roundTripper = newResponseCache(roundTripper, *cacheSize, *cacheMaxObject)
+	}
+	client := newUpstreamClient(roundTripper)
+	proxyCfg := proxyConfig{
+		targetURL:     strings.TrimSuffix(parsedTarget.String(), "/"),
+		forwardedHost: *domain,
+		upstreamHost:  parsedTarget.Host,
+		hostMode:      hostMode,
+		client:        client,
+		upstreamUser:  upstreamUser,
+
+		addPathPrefix:     normalizePathPrefix(*addPathPrefix),
+		stripPathPrefix:   normalizePathPrefix(*stripPathPrefix),
+		rejectPrefixMiss:  rejectPrefixMiss,
+		defaultTargetURL:  defaultURL,
+		defaultTargetHost: defaultHost,
+		defaultTargetUser: defaultUser,
+		noRouteStatus:     *noRouteStatus,
+		canonicalHost:     *canonicalHost,
+		errorPage:         errorPage,
+		retryAfter:        *retryAfter,
+		upstreamTimeout:   *upstreamTimeout,
+		deadlineHeader:    *deadlineHeader,
+		deadlineFormat:    *deadlineFormat,
+		viaName:           viaName,
+		forwardedServer:   forwardedServer,
+		stats:             stats,
+		bufferResponses:   *bufferResponses,
+		logTLS:            *logTLS,
+		logLatency:        *logLatency,
+		backendOverride:   *allowBackendOverride,
+		trustedProxies:    trustedNetworks,
+		softTimeout:       *softTimeout,
+
+		trailingSlash:        trailingSlashPolicy,
+		trailingSlashRewrite: trailingSlashRewrite,
+		statusRemap:          statusRemap,
+		remapStatusBody:      *remapStatusBody,
+		statusBodies:         statusBodies,
+		logHeaders:           *logHeaders,
+		redactHeaders:        redacted,
+		canaryURL:            canaryURL,
+		canaryHost:           canaryHost,
+		canaryUser:           canaryUser,
+		canaryPercent:        *canaryPercent,
+		canaryCookie:         *canaryCookie,
+		hashHeader:           strings.TrimSpace(*hashHeader),
+		hashRing:             ring,
+		maxURILength:         *maxURILength,
+		forwardClientCert:    *forwardClientCert,
+		forwardClientCertPEM: *forwardClientCertPEM,
+		accessLogFormat:      *accessLogFormat,
+		stripResponseHeaders: stripped,
+		allowResponseHeaders: allowed,
+		window:               window,
+		forwardHeadersOnly:   *forwardHeadersOnly,
+		methodOverrideHeader: *methodOverrideHeader,
+		requestIDHeader:      *requestIDHeader,
+		auditLog:             auditLog,
+		accessLogJSON:        accessLogJSON,
+		auditPaths:           auditPaths,
+		auditMaxBody:         *auditMaxBody,
+		auditRedact:          auditRedact,
+		maxRedirects:         *maxRedirects,
+		redirectTimeout:      *redirectTimeout,
+		faultDelay:           *faultDelay,
+		faultDelayPercent:    *faultDelayPercent,
+		faultAbortStatus:     *faultAbortStatus,
+		faultAbortPercent:    *faultAbortPercent,
+		serverTiming:         *serverTiming,
+		jsonErrors:           *errorFormat == "json",
+		allowedHosts:         hostAllowlist,
+		transforms:           transforms,
+		decompressRequest:    *decompressRequest,
+		maxDecompressedBody:  *maxDecompressedBody,
+		retries:              *retries,
+		retryBase:            *retryBase,
+		retryMax:             *retryMax,
+		retryJitter:          *retryJitter,
+		normalizePath:        *normalizePath,
+		normalizeRouteOnly:   normalizeRouteOnly,
+		maxHeaderCount:       *maxHeaderCount,
+		securityHeaders:      securityHeaders,
+		optionsHeaders:       optionsHeaders,
+		idempotency:          idempotency,
+		health:               health,
+		idempotencyHeader:    strings.TrimSpace(*idempotencyHeader),
+	}
+
+	// Port-based routing: each --listen mapping reuses every proxy setting except the backend it forwards to.
+	var mappedPorts []portMapping
+	for _, value := range listenMappings {
+		mapping, err := parsePortMapping(value)
+		if err != nil {
+			exitWithError("Invalid listen value", err)
+		}
+		if *upstreamScheme != "" {
+			mapping.target.Scheme = *upstreamScheme
+		}
+		mappedPorts = append(mappedPorts, mapping)
+	}
+	var fileMappings []portMapping
+	if *listenFilePath != "" {
+		fileMappings, err = readListenFile(*listenFilePath, *upstreamScheme)
+		if err != nil {
+			exitWithError("Invalid listen-file value", err)
+		}
+	}
+
+	// Per-backend timeouts are keyed by host; a key that names no configured backend is almost certainly a typo,
+	// unless it is meant for requests pinned with X-Proxy-Backend.
+	if len(backendTimeoutValues) > 0 {
+		configured := map[string]bool{strings.ToLower(proxyCfg.upstreamHost): true}
+		if proxyCfg.canaryURL != "" {
+			configured[strings.ToLower(proxyCfg.canaryHost)] = true
+		}
+		if proxyCfg.defaultTargetURL != "" {
+			configured[strings.ToLower(proxyCfg.defaultTargetHost)] = true
+		}
+		for _, backend := range hashBackends {
+			configured[strings.ToLower(backend.host)] = true
+		}
+		for _, mapping := range append(mappedPorts, fileMappings...) {
+			configured[strings.ToLower(mapping.target.Host)] = true
+		}
+		proxyCfg.backendTimeouts = make(map[string]time.Duration)
+		for _, value := range backendTimeoutValues {
+			host, timeout, err := parseBackendTimeout(value)
+			if err != nil {
+				exitWithError("Invalid backend-timeout value", err)
+			}
+			if !configured[host] && !proxyCfg.backendOverride {
+				exitWithError("Invalid backend-timeout value", fmt.Errorf("%s is not a --target-url, --canary-target, --default-target, --hash-backend or --listen backend", host))
+			}
+			proxyCfg.backendTimeouts[host] = timeout
+		}
+	}
+	handler := proxyHandler(proxyCfg)
+
+	listeners := listenerConfig{
+		maxConnsPerIP: *maxConnsPerIP,
+		acceptBackoff: *acceptBackoff,
+		network:       *network,
+		noDelay:       *tcpNoDelay,
+		readBuffer:    *tcpReadBuffer,
+		writeBuffer:   *tcpWriteBuffer,
+	}
+	if *tcpReadBuffer < 0 || *tcpWriteBuffer < 0 {
+		exitWithError("Invalid TCP buffer size", fmt.Errorf("read %d, write %d", *tcpReadBuffer, *tcpWriteBuffer))
+	}
+
+	// In coordinated startups the backend's DNS name may not exist yet; binding only once it resolves keeps the
+	// proxy from passing readiness checks while every request would still fail.
+	if *waitForTarget > 0 {
+		if err := waitForResolvable(parsedTarget.Hostname(), *waitForTarget); err != nil {
+			exitWithError("Target URL did not become resolvable", err)
+		}
+	}
+
+	// errorChan collects startup/runtime issues from goroutines so we can surface them to systemd.
+	// Buffer keeps the channel writable even if every server fails in quick succession during shutdown.
+	errorChan := make(chan error, 3+len(mappedPorts))
+
+	// Start HTTP server. If a domain is given, this will always be on port 80.
+	// If no domain is given, this uses the user-specified port.
+	// Every listener is bound before any server starts, so a busy port aborts startup cleanly instead of half-starting.
+	var httpListener net.Listener
+	if *httpPort != "" {
+		httpListener = bindOrExit("HTTP", ":"+*httpPort, listeners.listen)
+	}
+
+	mappedListeners := make([]net.Listener, len(mappedPorts))
+	for i, mapping := range mappedPorts {
+		mappedListeners[i] = bindOrExit("HTTP", mapping.addr, listeners.listen)
+	}
+	fileListeners := make([]net.Listener, len(fileMappings))
+	for i, mapping := range fileMappings {
+		fileListeners[i] = bindOrExit("HTTP", mapping.addr, listeners.listen)
+	}
+
+	// If a domain or a static certificate is specified, set up HTTPS on the specified port.
+	var httpsListener net.Listener
+	var staticCerts certSet
+	if *domain != "" || useStaticTLS {
+		var tlsConfig *tls.Config
+		if useStaticTLS {
+			// Load every pair up front so a bad certificate stops startup instead of failing handshakes later.
+			for i := range tlsCerts {
+				reloader, err := newCertReloader(tlsCerts[i], tlsKeys[i])
+				if err != nil {
+					exitWithError(fmt.Sprintf("Failed to load TLS certificate %s", tlsCerts[i]), err)
+				}
+				staticCerts = append(staticCerts, reloader)
+			}
+			tlsConfig = &tls.Config{
+				GetCertificate: staticCerts.GetCertificate,
+				NextProtos:     []string{"h2", "http/1.1"},
+			}
+		} else {
+			// Obtain the user's home directory to store certificates.
+			homeDir, err := os.UserHomeDir()
+			if err != nil {
+				exitWithError("Failed to get user home directory", err)
+			}
+
+			// Setup the directory to store TLS certificates.
+			certDir := filepath.Join(homeDir, ".chicha-http-proxy-ssl-certs")
+			if err := os.MkdirAll(certDir, 0700); err != nil {
+				exitWithError("Failed to create cert directory", err)
+			}
+
+			// With canonical redirects both hostname forms must present a valid certificate before they can redirect.
+			hosts := []string{*domain}
+			if *canonicalHost != "" {
+				hosts = append(hosts, alternateHost(*domain))
+			}
+
+			m := &autocert.Manager{
+				Cache:      autocert.DirCache(certDir),
+				Prompt:     autocert.AcceptTOS,
+				HostPolicy: autocert.HostWhitelist(hosts...),
+			}
+			tlsConfig = m.TLSConfig()
+		}
+
+		// Optional verification lets one listener serve browsers and mTLS clients alike; the backend sees who authenticated.
+		if clientCAs != nil {
+			tlsConfig.ClientCAs = clientCAs
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+			if *requireClientCert {
+				tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+		}
+
+		// We own the tls.Config instead of letting ServeTLS clone it, otherwise rotated ticket keys would never reach the listener.
+		if *ticketRotation > 0 {
+			go rotateSessionTicketKeys(tlsConfig, *ticketRotation)
+		}
+
+		rawHTTPSListener := bindOrExit("HTTPS", ":"+*httpsPort, listeners.listen)
+		if *tlsHandshakeTimeout > 0 {
+			httpsListener = newHandshakeListener(rawHTTPSListener, tlsConfig, *tlsHandshakeTimeout)
+		} else {
+			httpsListener = tls.NewListener(rawHTTPSListener, tlsConfig)
+		}
+	}
+
+	// The admin listener is separate from the proxy ports so operational endpoints stay on a private address.
+	var adminListener net.Listener
+	if *adminBind != "" {
+		adminListener = bindOrExit("Admin", *adminBind, func(addr string) (net.Listener, error) {
+			return net.Listen("tcp", addr)
+		})
+	}
+
+	// The PID file is only written once every listener is bound: bindOrExit exits without running deferred calls,
+	// so a port clash must not leave a file behind that names a process which never served.
+	if *pidFile != "" {
+		if err := writePIDFile(*pidFile, *forcePIDFile); err != nil {
+			exitWithError("Failed to write PID file", err)
+		}
+		defer removePIDFile(*pidFile)
+	}
+
+	if !*quiet {
+		// Values are left out of the option list on purpose: URLs, headers and secrets passed as flags may carry credentials.
+		var rows []bannerRow
+		if httpListener != nil {
+			rows = append(rows, bannerRow{"HTTP", fmt.Sprintf("port %s -> %s", listenerPort(httpListener), parsedTarget)})
+		}
+		where := func(mapping portMapping, listener net.Listener) string {
+			if host, _, _ := net.SplitHostPort(mapping.addr); host != "" {
+				return listener.Addr().String()
+			}
+			return "port " + listenerPort(listener)
+		}
+		for i, mapping := range mappedPorts {
+			rows = append(rows, bannerRow{"HTTP", fmt.Sprintf("%s -> %s", where(mapping, mappedListeners[i]), mapping.target)})
+		}
+		for i, mapping := range fileMappings {
+			rows = append(rows, bannerRow{"HTTP", fmt.Sprintf("%s -> %s (listen file, reloads on SIGHUP)", where(mapping, fileListeners[i]), mapping.target)})
+		}
+		if httpsListener != nil {
+			rows = append(rows, bannerRow{"HTTPS", fmt.Sprintf("port %s -> %s", listenerPort(httpsListener), parsedTarget)})
+		}
+		switch {
+		case useStaticTLS:
+			rows = append(rows, bannerRow{"TLS", fmt.Sprintf("static, %d certificate(s)", len(tlsCerts))})
+		case *domain != "":
+			rows = append(rows, bannerRow{"TLS", "Let's Encrypt for " + *domain})
+		default:
+			rows = append(rows, bannerRow{"TLS", "none"})
+		}
+		if clientCAs != nil {
+			mode := "optional client certificates"
+			if *requireClientCert {
+				mode = "required client certificates"
+			}
+			rows = append(rows, bannerRow{"mTLS", mode})
+		}
+		if defaultURL != "" {
+			rows = append(rows, bannerRow{"Default", fmt.Sprintf("outside %s -> %s", normalizePathPrefix(*stripPathPrefix), defaultURL)})
+		}
+		if canaryURL != "" {
+			rows = append(rows, bannerRow{"Canary", fmt.Sprintf("%d%% -> %s", *canaryPercent, canaryURL)})
+		}
+		for _, backend := range hashBackends {
+			rows = append(rows, bannerRow{"Hash", fmt.Sprintf("%s weight %d -> %s", *hashHeader, backend.weight, backend.target)})
+		}
+		if adminListener != nil {
+			rows = append(rows, bannerRow{"Admin", adminListener.Addr().String()})
+		}
+		var options []string
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "target-url", "http-port", "https-port", "domain", "listen", "listen-file", "tls-cert", "tls-key", "canary-target", "canary-percent", "default-target", "hash-backend", "admin-bind":
+			default:
+				options = append(options, "--"+f.Name)
+			}
+		})
+		if len(options) == 0 {
+			options = append(options, "defaults")
+		}
+		rows = append(rows, bannerRow{"Options", strings.Join(options, " ")})
+		printStartupBanner(rows)
+	}
+
+	// Servers are created up front so the shutdown sequence can reach them.
+	var httpServer, httpsServer, adminServer *http.Server
+
+	if httpListener != nil {
+		httpServer = &http.Server{
+			Addr:    ":" + *httpPort,
+			Handler: cleartextHandler(handler, *enableH2C),
+		}
+		go func() {
+			log.Printf("Starting HTTP proxy on port %s targeting %s", listenerPort(httpListener), parsedTarget)
+			if err := httpServer.Serve(httpListener); err != nil && err != http.ErrServerClosed {
+				wrappedErr := fmt.Errorf("HTTP server error: %w", err)
+				log.Printf("HTTP server failed: %v", err)
+				errorChan <- wrappedErr
+			}
+		}()
+	}
+
+	var mappedServers []*http.Server
+	for i, mapping := range mappedPorts {
+		server := &http.Server{
+			Addr:    mapping.addr,
+			Handler: cleartextHandler(proxyHandler(mappingConfig(proxyCfg, mapping)), *enableH2C),
+		}
+		mappedServers = append(mappedServers, server)
+		listener := mappedListeners[i]
+		go func() {
+			log.Printf("Starting HTTP proxy on port %s targeting %s", listenerPort(listener), mapping.target)
+			if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+				log.Printf("HTTP server on %s failed: %v", mapping.addr, err)
+				errorChan <- fmt.Errorf("HTTP server error on %s: %w", mapping.addr, err)
+			}
+		}()
+	}
+
+	var reloadable *listenFile
+	if *listenFilePath != "" {
+		reloadable = &listenFile{
+			path:            *listenFilePath,
+			scheme:          *upstreamScheme,
+			base:            proxyCfg,
+			bind:            listeners.listen,
+			enableH2C:       *enableH2C,
+			shutdownTimeout: *shutdownTimeout,
+			running:         make(map[string]*fileListener),
+		}
+		reloadable.mu.Lock()
+		for i, mapping := range fileMappings {
+			reloadable.start(mapping, fileListeners[i])
+		}
+		reloadable.mu.Unlock()
+		go reloadable.reloadOnSignal()
+	}
+
+	if httpsListener != nil {
+		httpsServer = &http.Server{
+			Addr:    ":" + *httpsPort,
+			Handler: handler,
+		}
+		// Connection states are only tracked when a certificate reload may need to close idle HTTP/2 connections.
+		httpsConns := &idleConnTracker{idle: make(map[net.Conn]bool)}
+		if useStaticTLS && *certReloadDrain > 0 {
+			httpsServer.ConnState = httpsConns.track
+		}
+		go func() {
+			if useStaticTLS {
+				log.Printf("Starting HTTPS proxy with static certificate on port %s targeting %s", listenerPort(httpsListener), parsedTarget)
+			} else {
+				log.Printf("Starting HTTPS proxy on domain %s and port %s targeting %s", *domain, listenerPort(httpsListener), parsedTarget)
+			}
+			if err := httpsServer.Serve(httpsListener); err != nil && err != http.ErrServerClosed {
+				wrappedErr := fmt.Errorf("HTTPS server error: %w", err)
+				log.Printf("HTTPS server failed: %v", err)
+				errorChan <- wrappedErr
+			}
+		}()
+
+		// SIGHUP reloads only apply to static certificates; Let's Encrypt renewals are handled by autocert.
+		if useStaticTLS {
+			var onReload func()
+			if *certReloadDrain > 0 {
+				onReload = func() { drainKeepAlives(httpsServer, httpsConns, *certReloadDrain) }
+			}
+			go staticCerts.reloadOnSignal(onReload)
+		}
+	}
+
+	if adminListener != nil {
+		adminServer = &http.Server{
+			Addr:    *adminBind,
+			Handler: adminHandler(stats, adminAllowed, parsedTarget.String()),
+		}
+		go func() {
+			log.Printf("Starting admin listener on %s", adminListener.Addr())
+			if err := adminServer.Serve(adminListener); err != nil && err != http.ErrServerClosed {
+				wrappedErr := fmt.Errorf("Admin server error: %w", err)
+				log.Printf("Admin server failed: %v", err)
+				errorChan <- wrappedErr
+			}
+		}()
+	}
+
+	// SIGINT/SIGTERM start a graceful shutdown instead of cutting in-flight requests.
+	shutdownSignals := make(chan os.Signal, 1)
+	signal.Notify(shutdownSignals, syscall.SIGINT, syscall.SIGTERM)
+
+	// Block until a goroutine reports an unrecoverable error so we can show it directly.
+	select {
+	case err := <-errorChan:
+		reportFatal(fmt.Sprintf("Fatal error: %v", err))
+		if *pidFile != "" {
+			removePIDFile(*pidFile)
+		}
+		os.Exit(1)
+	case sig := <-shutdownSignals:
+		log.Printf("Received %s, shutting down (order: %s)", sig, *shutdownOrder)
+		// The admin listener goes last so health and stats stay observable while traffic drains.
+		httpServers := append([]*http.Server{httpServer}, mappedServers...)
+		if reloadable != nil {
+			httpServers = append(httpServers, reloadable.servers()...)
+		}
+		stages := shutdownStages(*shutdownOrder, httpServers, httpsServer)
+		drained := len(stages)
+		stages = append(stages, []*http.Server{adminServer})
+		shutdownInStages(stages, drained, *shutdownDrainDelay, *shutdownTimeout)
+		log.Printf("Shutdown complete")
+		flushLogs()
 	}
 }
@@ -2,9 +2,9 @@ module chicha-proxy
 
 go 1.23
 
-require golang.org/x/crypto v0.29.0
-
 require (
-	golang.org/x/net v0.21.0 // indirect
-	golang.org/x/text v0.20.0 // indirect
+	golang.org/x/crypto v0.29.0
+	golang.org/x/net v0.21.0
 )
+
+require golang.org/x/text v0.20.0 // indirect